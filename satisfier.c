@@ -4,13 +4,118 @@
 #include <string.h>
 #include <stdint.h>
 #include <inttypes.h>
+#include <time.h>
 #include <omp.h>
+#ifdef _WIN32
+#include <windows.h>
+#include <io.h>
+#ifndef ENABLE_VIRTUAL_TERMINAL_PROCESSING
+#define ENABLE_VIRTUAL_TERMINAL_PROCESSING 0x0004
+#endif
+#define isatty _isatty
+#define fileno _fileno
+#define dup    _dup
+#define dup2   _dup2
+#define close  _close
+#define NULL_DEVICE "NUL"
+#else
+#include <sys/resource.h>
+#include <unistd.h>
+#define NULL_DEVICE "/dev/null"
+#endif
 
 typedef struct {
     int *orig;
     int  sz;
+    int  idx;   // 1-based number among the clause lines of the input;
+                // compiled clauses are numbered after them
+    int  line;  // input line the clause was read or compiled from
 } Clause;
 
+// Linear pseudo-Boolean constraint in OPB form: sum coef*lit REL rhs
+typedef struct {
+    long long *coef;
+    int       *lit;   // xN is N, ~xN is -N
+    int        n;
+    char       rel;   // 'G' for >=, 'L' for <=, 'E' for =
+    long long  rhs;
+    int        line;
+} PBConstraint;
+
+// Command line options
+static struct {
+    uint64_t limit;      // most assignments to print, 0 for no limit
+    int     *project;    // variables to project models onto, in order
+    int      n_project;
+    int     *forget;     // variables quantified away by --forget
+    int      n_forget;
+    uint64_t sample;     // number of random models to draw, 0 to enumerate
+    const char *check;   // solver output whose model is verified
+    bool     mus;        // report a minimal unsatisfiable subset
+    bool     explain_all; // enumerate every MUS and MCS
+    const char *proof;   // DRAT proof file written for unsatisfiable input
+    const char *prefer;  // baseline assignment as a string of 0/1 bits
+    bool     verify;     // re-check every printed model against the input
+    bool     prime;      // reduce the first model to a prime implicant
+    int      implicates; // list prime implicates up to this size, -1 for none
+    bool     minimize;   // print a small equivalent set of clauses
+    int     *cost_lit;   // literals with a cost for --cost
+    long long *cost;
+    int      n_cost;
+    double   timeout;    // seconds per solve, 0 for no limit
+    bool     stats;      // print statistics after each solve
+    int      selftest;   // random formulas to cross-check, 0 to solve input
+    bool     seeded;     // --seed was given
+    uint64_t seed;       // seed for randomized choices
+    int      jobs;       // worker threads, 0 for one per core
+    bool     local;      // --engine local: search for one model, never prove unsat
+    bool     verbose;    // report simplifications made to the input
+    bool     json;       // --output json: one JSON object per solve
+    bool     quiet;      // print nothing, report the last result by exit status
+    bool     no_color;   // never color results, even on a terminal
+    bool     progress;   // report progress on stderr during long solves
+    const char *format;  // input format, "auto" to detect per line
+} opt = { .format = "auto", .implicates = -1 };
+
+// Extensional table constraint: the allowed tuples of values of the
+// scope variables, each tuple packed with the first variable highest
+typedef struct {
+    int      *var;
+    int       n;
+    uint64_t *rows;   // sorted
+    int       n_rows;
+    int       line;
+} TableConstraint;
+
+// Node of a propositional formula tree. For 'v' a is the variable; for
+// 'c' a is the constant 0 or 1; for '!' a is the operand; for the binary operators '&', '|', '^' (xor),
+// '>' (implies) and '=' (iff) a and b are the operands.
+typedef struct {
+    char op;
+    int  a, b;
+} FormulaNode;
+
+// Arbitrary propositional formula over the clause variables
+typedef struct {
+    FormulaNode *node;
+    int          n;
+    int          root;
+    int          max_var;
+    int          line;
+} FormulaConstraint;
+
+// Outcome of a solve. Unknown covers every case where the search stopped
+// before the answer was known; invalid is input the mode cannot handle.
+typedef enum {
+    RESULT_SAT,
+    RESULT_UNSAT,
+    RESULT_UNKNOWN,
+    RESULT_INVALID
+} Result;
+
+// Constraints are compiled to clauses by enumerating assignments
+#define MAX_COMPILE_VARS 20
+
 // Portable getline
 static ssize_t getline(char **lineptr, size_t *n, FILE *stream) {
     if (!lineptr || !n || !stream) return -1;
@@ -33,262 +138,3262 @@ static ssize_t getline(char **lineptr, size_t *n, FILE *stream) {
     return (ssize_t)len;
 }
 
-static Clause* read_clause(int *out_M) {
-    Clause *C = NULL;
-    int cap = 0, M = 0;
-    char *line = NULL;
-    size_t linecap = 0;
-    ssize_t linelen;
+// Pseudo-Boolean and table constraints read since the last solve
+static PBConstraint    *pb;
+static int              pb_n, pb_cap;
+static TableConstraint *tables;
+static int              table_n, table_cap;
+static FormulaConstraint *formulas;
+static int                formula_n, formula_cap;
+static int           input_error_line;
+static const char   *input_error;
+static int           input_error_col;    // 1-based, 0 when not known
+static char         *input_error_text;   // the offending line, for the caret
 
-    printf("Enter clause(s) and blank line to finish:\n");
-    while ((linelen = getline(&line, &linecap, stdin)) != -1) {
-        if (linelen == 1 && line[0] == '\n') break;
-        if (M == cap) {
-            cap = cap ? cap * 2 : 4;
-            C = realloc(C, cap * sizeof(Clause));
+// Quantifier prefix read from QDIMACS 'a' and 'e' lines
+static char *qbf_quant;   // per variable: 'a', 'e', or 0 when free
+static int  *qbf_order;   // quantified variables in prefix order
+static int   qbf_n, qbf_cap, qbf_vars;
+
+static void free_qbf_prefix(void) {
+    free(qbf_quant);
+    free(qbf_order);
+    qbf_quant = NULL;
+    qbf_order = NULL;
+    qbf_n = qbf_cap = qbf_vars = 0;
+}
+
+// Record an input error; the one on the earliest line is reported
+static void set_input_error(int lineno, const char *err) {
+    if (input_error_line && input_error_line <= lineno) return;
+    input_error_line = lineno;
+    input_error      = err;
+    free(input_error_text);
+    input_error_text = NULL;
+    input_error_col  = 0;
+}
+
+// Record an error at a column of the line, so it can be shown with a caret
+static void set_input_error_at(int lineno, const char *err, const char *line, int col) {
+    if (input_error_line && input_error_line <= lineno) return;
+    set_input_error(lineno, err);
+    size_t len = strcspn(line, "\r\n");
+    input_error_text = malloc(len + 1);
+    memcpy(input_error_text, line, len);
+    input_error_text[len] = '\0';
+    input_error_col = col;
+}
+
+// Parse one quantifier block like "a 1 2 0" or "e 3 0"
+static void parse_prefix_line(char *line, int lineno) {
+    char q = line[0];
+    for (char *tok = strtok(line + 1, " \t\r\n"); tok; tok = strtok(NULL, " \t\r\n")) {
+        char *end;
+        long v = strtol(tok, &end, 10);
+        if (*end || v < 0) { set_input_error(lineno, "malformed quantifier block"); return; }
+        if (!v) break;
+        if (v >= qbf_vars) {
+            int n = (int)v + 1;
+            qbf_quant = realloc(qbf_quant, n);
+            memset(qbf_quant + qbf_vars, 0, n - qbf_vars);
+            qbf_vars = n;
         }
-        int *temp = NULL, tcap = 0, tsz = 0;
-        for (char *tok = strtok(line, " \t\n"); tok; tok = strtok(NULL, " \t\n")) {
-            int lit = atoi(tok);
-            if (!lit) continue;
-            if (tsz == tcap) {
-                tcap = tcap ? tcap * 2 : 4;
-                temp = realloc(temp, tcap * sizeof(int));
-            }
-            temp[tsz++] = lit;
+        if (qbf_quant[v]) { set_input_error(lineno, "variable quantified twice"); return; }
+        qbf_quant[v] = q;
+        if (qbf_n == qbf_cap) {
+            qbf_cap = qbf_cap ? qbf_cap * 2 : 8;
+            qbf_order = realloc(qbf_order, qbf_cap * sizeof(*qbf_order));
         }
-        C[M].orig = temp;
-        C[M].sz   = tsz;
-        M++;
+        qbf_order[qbf_n++] = (int)v;
     }
-    free(line);
-    *out_M = M;
-    return C;
 }
 
-static bool I_process_clause(Clause *clause, int M) {
-    if (M == 0) {
-        printf("Result:\n");
-        printf("No input\n\n");
-        free(clause);
-        return false;
+static void free_constraints(void) {
+    for (int i = 0; i < pb_n; i++) {
+        free(pb[i].coef);
+        free(pb[i].lit);
     }
-    int first_sz = clause[0].sz;
-    for (int i = 1; i < M; i++) {
-        if (clause[i].sz != first_sz) {
-            printf("Result:\n");
-            printf(
-              "Invalid input, clause (1) and clause (%d) have different number of literals\n\n",
-              i + 1
-            );
-            // clean up
-            #pragma omp parallel for
-            for (int j = 0; j < M; j++)
-                free(clause[j].orig);
-            free(clause);
-            return false;
-        }
+    free(pb);
+    pb = NULL;
+    pb_n = pb_cap = 0;
+    for (int i = 0; i < table_n; i++) {
+        free(tables[i].var);
+        free(tables[i].rows);
     }
-    // Check for duplicated literals within each clause
-    for (int i = 0; i < M; i++) {
-        for (int j = 0; j < clause[i].sz; j++) {
-            for (int k = j + 1; k < clause[i].sz; k++) {
-                if (clause[i].orig[j] == clause[i].orig[k]) {
-                    printf("Result:\n");
-                    printf("Invalid input, literal %d is duplicated in clause (%d)\n\n", clause[i].orig[j], i + 1);
-                    #pragma omp parallel for
-                    for (int t = 0; t < M; t++) free(clause[t].orig);
-                    free(clause);
-                    return false;
-                }
+    free(tables);
+    tables = NULL;
+    table_n = table_cap = 0;
+    for (int i = 0; i < formula_n; i++)
+        free(formulas[i].node);
+    free(formulas);
+    formulas = NULL;
+    formula_n = formula_cap = 0;
+    input_error_line = 0;
+    input_error = NULL;
+    free(input_error_text);
+    input_error_text = NULL;
+    input_error_col = 0;
+}
+
+// Parse one OPB constraint like "+2 x1 +3 ~x2 >= 4 ;"
+static void parse_pb_line(char *line, int lineno) {
+    PBConstraint c = { NULL, NULL, 0, 0, 0, lineno };
+    int cap = 0;
+    long long sign = 1, coef = 0;
+    bool have_coef = false, have_rhs = false;
+    const char *err = NULL;
+
+    for (char *tok = strtok(line, " \t\r\n"); tok && !err; tok = strtok(NULL, " \t\r\n")) {
+        size_t len = strlen(tok);
+        if (len && tok[len - 1] == ';') tok[--len] = '\0';
+        if (!len) continue;
+
+        if (c.rel) {
+            char *end;
+            if (have_rhs) { err = "more than one right-hand side"; break; }
+            c.rhs = strtoll(tok, &end, 10);
+            if (*end) { err = "right-hand side is not a number"; break; }
+            have_rhs = true;
+        } else if (!strcmp(tok, ">=") || !strcmp(tok, "<=") || !strcmp(tok, "=")) {
+            if (have_coef) { err = "coefficient without a variable"; break; }
+            c.rel = tok[0] == '>' ? 'G' : tok[0] == '<' ? 'L' : 'E';
+        } else if (!strcmp(tok, "+") || !strcmp(tok, "-")) {
+            if (tok[0] == '-') sign = -sign;
+        } else if (tok[0] == 'x' || (tok[0] == '~' && tok[1] == 'x')) {
+            bool neg = tok[0] == '~';
+            char *end;
+            long v = strtol(tok + (neg ? 2 : 1), &end, 10);
+            if (*end || v <= 0) { err = "malformed variable"; break; }
+            if (c.n == cap) {
+                cap = cap ? cap * 2 : 4;
+                c.coef = realloc(c.coef, cap * sizeof(*c.coef));
+                c.lit  = realloc(c.lit,  cap * sizeof(*c.lit));
             }
+            c.coef[c.n] = sign * (have_coef ? coef : 1);
+            c.lit[c.n]  = neg ? -(int)v : (int)v;
+            c.n++;
+            sign = 1; coef = 0; have_coef = false;
+        } else if (!strcmp(tok, "min:") || !strcmp(tok, "max:")) {
+            err = "objective functions are not supported";
+        } else {
+            char *end;
+            if (have_coef) { err = "two coefficients in a row"; break; }
+            coef = strtoll(tok, &end, 10);
+            if (*end) { err = "unexpected token"; break; }
+            have_coef = true;
         }
     }
-    return true;
+    if (!err && !c.rel)   err = "missing relation (>=, <= or =)";
+    if (!err && !have_rhs) err = "missing right-hand side";
+
+    if (err) {
+        set_input_error(lineno, err);
+        free(c.coef);
+        free(c.lit);
+        return;
+    }
+    if (pb_n == pb_cap) {
+        pb_cap = pb_cap ? pb_cap * 2 : 4;
+        pb = realloc(pb, pb_cap * sizeof(*pb));
+    }
+    pb[pb_n++] = c;
 }
 
-// Process one clause: record forbidden bits per literal position
-static void II_process_clause(const Clause *c,
-                           int row_len,
-                           unsigned char *out_row,
-                           bool *early_unsat_flag,
-                           int clause_idx)
-{
-    if (c->sz < 2) {
-        #pragma omp critical
-        {
-            printf("Invalid input, clause (%d) should have at least two literals\n", clause_idx + 1);
-            *early_unsat_flag = true;
+// Parse a cardinality constraint like "atmost(2, 1, -2, 3)" into a
+// pseudo-Boolean constraint with unit coefficients
+static void parse_card_line(char *line, int lineno) {
+    PBConstraint c = { NULL, NULL, 0, 0, 0, lineno };
+    bool at_most = !strncmp(line, "atmost", 6);
+    char *p = line + (at_most ? 6 : 7);
+    const char *err = NULL;
+    int cap = 0;
+
+    while (*p == ' ' || *p == '\t') p++;
+    if (*p != '(' || !strchr(p, ')')) {
+        err = "missing parentheses";
+    } else {
+        *strchr(p, ')') = '\0';
+        bool have_bound = false;
+        for (char *tok = strtok(p + 1, ", \t"); tok && !err; tok = strtok(NULL, ", \t")) {
+            char *end;
+            long v = strtol(tok, &end, 10);
+            if (*end) { err = "unexpected token"; break; }
+            if (!have_bound) {
+                if (v < 0) { err = "negative cardinality bound"; break; }
+                c.rhs = v;
+                have_bound = true;
+                continue;
+            }
+            if (!v) { err = "literal 0 in cardinality constraint"; break; }
+            if (c.n == cap) {
+                cap = cap ? cap * 2 : 4;
+                c.coef = realloc(c.coef, cap * sizeof(*c.coef));
+                c.lit  = realloc(c.lit,  cap * sizeof(*c.lit));
+            }
+            c.coef[c.n] = 1;
+            c.lit[c.n]  = (int)v;
+            c.n++;
         }
+        if (!err && !have_bound) err = "missing cardinality bound";
+    }
+
+    if (err) {
+        set_input_error(lineno, err);
+        free(c.coef);
+        free(c.lit);
         return;
     }
+    c.rel = at_most ? 'L' : 'G';
+    if (pb_n == pb_cap) {
+        pb_cap = pb_cap ? pb_cap * 2 : 4;
+        pb = realloc(pb, pb_cap * sizeof(*pb));
+    }
+    pb[pb_n++] = c;
+}
 
-    // Detect if same var appears both pos and neg in clause
-    // Small local map: since clause small, O(n^2) is fine
-    for (int i = 0; i < c->sz; i++) {
-        for (int j = i + 1; j < c->sz; j++) {
-            if (c->orig[i] + c->orig[j] == 0) {
-                #pragma omp critical
-                {
-                    int v = abs(c->orig[i]);
-                    printf("Tautology, clause (%d) contains both %d and -%d\n",
-                           clause_idx + 1, v, v);
-                    *early_unsat_flag = true;
-                }
-                return;
+// Whether assignment v over k variables satisfies a pseudo-Boolean constraint
+static bool pb_holds(const PBConstraint *c, uint64_t v, int k) {
+    long long sum = 0;
+    for (int i = 0; i < c->n; i++) {
+        int var = abs(c->lit[i]);
+        int bit = (v >> (k - var)) & 1;
+        if (c->lit[i] < 0) bit = !bit;
+        if (bit) sum += c->coef[i];
+    }
+    if (c->rel == 'G') return sum >= c->rhs;
+    if (c->rel == 'L') return sum <= c->rhs;
+    return sum == c->rhs;
+}
+
+static int cmp_u64(const void *a, const void *b) {
+    uint64_t x = *(const uint64_t *)a, y = *(const uint64_t *)b;
+    return (x > y) - (x < y);
+}
+
+// Parse a table constraint like "table(1, 2, 3: 101, 110, 011)" listing
+// the allowed values of the scope variables as bit strings
+static void parse_table_line(char *line, int lineno) {
+    TableConstraint c = { NULL, 0, NULL, 0, lineno };
+    char *open = strchr(line, '('), *close = strrchr(line, ')');
+    char *colon = open ? strchr(open, ':') : NULL;
+    const char *err = NULL;
+    int cap = 0;
+
+    if (!open || !close || !colon || colon > close) {
+        err = "malformed table constraint";
+    } else {
+        *colon = *close = '\0';
+        for (char *tok = strtok(open + 1, ", \t"); tok; tok = strtok(NULL, ", \t")) {
+            char *end;
+            long v = strtol(tok, &end, 10);
+            if (*end || v <= 0) { err = "malformed table scope"; break; }
+            for (int i = 0; i < c.n; i++)
+                if (c.var[i] == v) err = "variable repeated in table scope";
+            if (err) break;
+            if (c.n == 64) { err = "table scope is too large"; break; }
+            c.var = realloc(c.var, (c.n + 1) * sizeof(*c.var));
+            c.var[c.n++] = (int)v;
+        }
+        for (char *tok = strtok(colon + 1, ", \t"); tok && !err; tok = strtok(NULL, ", \t")) {
+            if ((int)strlen(tok) != c.n || strspn(tok, "01") != strlen(tok)) {
+                err = "table tuple does not match the scope";
+                break;
             }
+            uint64_t row = 0;
+            for (int i = 0; i < c.n; i++)
+                row = (row << 1) | (tok[i] == '1');
+            if (c.n_rows == cap) {
+                cap = cap ? cap * 2 : 4;
+                c.rows = realloc(c.rows, cap * sizeof(*c.rows));
+            }
+            c.rows[c.n_rows++] = row;
         }
+        if (!err && !c.n) err = "empty table scope";
     }
-    // Mark forbidden: 1 for negative literal, 0 for positive
-    for (int i = 0; i < row_len; i++)
-        out_row[i] = (c->orig[i] < 0) ? 1 : 0;
+
+    if (err) {
+        set_input_error(lineno, err);
+        free(c.var);
+        free(c.rows);
+        return;
+    }
+    qsort(c.rows, c.n_rows, sizeof(*c.rows), cmp_u64);
+    if (table_n == table_cap) {
+        table_cap = table_cap ? table_cap * 2 : 4;
+        tables = realloc(tables, table_cap * sizeof(*tables));
+    }
+    tables[table_n++] = c;
 }
 
-// Convert a row of length C to a number
-static uint64_t forbidden_val(const unsigned char *row, int C) {
-    int s = 0;
-    while (s < C && row[s] == 0) s++;
-    if (s == C) return 0;
-    uint64_t v = 0;
-    for (int j = s; j < C; j++)
-        v = (v << 1) | row[j];
-    return v;
+// Whether assignment v over k variables is an allowed tuple of a table
+static bool table_holds(const TableConstraint *c, uint64_t v, int k) {
+    uint64_t key = 0;
+    for (int i = 0; i < c->n; i++)
+        key = (key << 1) | ((v >> (k - c->var[i])) & 1);
+    int lo = 0, hi = c->n_rows;
+    while (lo < hi) {
+        int mid = lo + (hi - lo) / 2;
+        if (c->rows[mid] < key) lo = mid + 1;
+        else hi = mid;
+    }
+    return lo < c->n_rows && c->rows[lo] == key;
+}
+
+// Recursive descent parser state for formula lines
+typedef struct {
+    const char        *p;
+    const char        *err;
+    FormulaConstraint *f;
+} FormulaParser;
+
+static int formula_iff(FormulaParser *ps);
+
+static void formula_skip_space(FormulaParser *ps) {
+    ps->p += strspn(ps->p, " \t\r\n");
+}
+
+static int formula_node(FormulaParser *ps, char op, int a, int b) {
+    FormulaConstraint *f = ps->f;
+    f->node = realloc(f->node, (f->n + 1) * sizeof(*f->node));
+    f->node[f->n] = (FormulaNode){ op, a, b };
+    return f->n++;
+}
+
+// Value of a binary operator on two truth values
+static bool formula_apply(char op, bool x, bool y) {
+    switch (op) {
+    case '&': return x && y;
+    case '|': return x || y;
+    case '^': return x != y;
+    case '>': return !x || y;
+    default:  return x == y;
+    }
+}
+
+// Add an operator node, folding true and false operands away so constants
+// only survive when the whole formula is constant
+static int formula_op(FormulaParser *ps, char op, int a, int b) {
+    const FormulaNode *nd = ps->f->node;
+    int ca = nd[a].op == 'c' ? nd[a].a : -1;
+    if (op == '!')
+        return ca >= 0 ? formula_node(ps, 'c', !ca, 0) : formula_node(ps, '!', a, 0);
+    int cb = nd[b].op == 'c' ? nd[b].a : -1;
+    if (ca >= 0 && cb >= 0)
+        return formula_node(ps, 'c', formula_apply(op, ca, cb), 0);
+    if (ca < 0 && cb < 0)
+        return formula_node(ps, op, a, b);
+    if (op == '>')
+        return ca >= 0 ? (ca ? b : formula_node(ps, 'c', 1, 0))
+                       : (cb ? formula_node(ps, 'c', 1, 0) : formula_op(ps, '!', a, 0));
+    // The remaining operators are symmetric: x op c
+    int x = ca >= 0 ? b : a, c = ca >= 0 ? ca : cb;
+    switch (op) {
+    case '&': return c ? x : formula_node(ps, 'c', 0, 0);
+    case '|': return c ? formula_node(ps, 'c', 1, 0) : x;
+    case '^': return c ? formula_op(ps, '!', x, 0) : x;
+    default:  return c ? x : formula_op(ps, '!', x, 0);
+    }
 }
 
-// Partition for quicksort
-static int partition_serial(uint64_t arr[], int low, int high) {
-    uint64_t pivot = arr[high];
-    int i = low - 1;
-    for (int j = low; j < high; j++) {
-        if (arr[j] <= pivot) {
-            i++;
-            uint64_t tmp = arr[i]; arr[i] = arr[j]; arr[j] = tmp;
+// unary := ('!' | '-') unary | '(' iff ')' | 'true' | 'false' | variable
+static int formula_unary(FormulaParser *ps) {
+    formula_skip_space(ps);
+    if (*ps->p == '!' || *ps->p == '-') {
+        ps->p++;
+        int a = formula_unary(ps);
+        return a < 0 ? -1 : formula_op(ps, '!', a, 0);
+    }
+    if (!strncmp(ps->p, "true", 4) || !strncmp(ps->p, "false", 5)) {
+        bool t = *ps->p == 't';
+        ps->p += t ? 4 : 5;
+        return formula_node(ps, 'c', t, 0);
+    }
+    if (*ps->p == '(') {
+        const char *open = ps->p++;
+        int a = formula_iff(ps);
+        if (a < 0) return -1;
+        formula_skip_space(ps);
+        if (*ps->p != ')') {
+            ps->p   = open;
+            ps->err = "unmatched ( in formula";
+            return -1;
         }
+        ps->p++;
+        return a;
+    }
+    char *end;
+    long v = strtol(ps->p, &end, 10);
+    if (end == ps->p || v <= 0 || v > 64 || *ps->p == '+') {
+        ps->err = "expected a variable in formula";
+        return -1;
     }
-    uint64_t tmp = arr[i+1]; arr[i+1] = arr[high]; arr[high] = tmp;
-    return i + 1;
+    ps->p = end;
+    if (v > ps->f->max_var) ps->f->max_var = (int)v;
+    return formula_node(ps, 'v', (int)v, 0);
 }
 
-// Parallel quicksort tasks
-void parallel_quick_sort(uint64_t *arr, int low, int high) {
-    if (low < high) {
-        int p = partition_serial(arr, low, high);
-        #pragma omp task shared(arr)
-        parallel_quick_sort(arr, low, p - 1);
-        #pragma omp task shared(arr)
-        parallel_quick_sort(arr, p + 1, high);
-        #pragma omp taskwait
+// and := unary ('&' unary)*
+static int formula_and(FormulaParser *ps) {
+    int a = formula_unary(ps);
+    for (;;) {
+        if (a < 0) return -1;
+        formula_skip_space(ps);
+        if (*ps->p != '&') return a;
+        ps->p++;
+        int b = formula_unary(ps);
+        a = b < 0 ? -1 : formula_op(ps, '&', a, b);
     }
 }
 
-// Find missing assignments across all clauses
-static bool get_assignments(int M,
-                            unsigned char **forbidden,
-                            int *clause_sizes)
-{
-    // Map each clause's forbidden row to a numeric value
-    uint64_t *vals = malloc((size_t)M * sizeof *vals);
-    if (!vals) { perror("malloc"); exit(1); }
+// xor := and (('xor' | '^') and)*
+static int formula_xor(FormulaParser *ps) {
+    int a = formula_and(ps);
+    for (;;) {
+        if (a < 0) return -1;
+        formula_skip_space(ps);
+        if (*ps->p == '^') ps->p++;
+        else if (!strncmp(ps->p, "xor", 3)) ps->p += 3;
+        else return a;
+        int b = formula_and(ps);
+        a = b < 0 ? -1 : formula_op(ps, '^', a, b);
+    }
+}
 
-    #pragma omp parallel for
-    for (int i = 0; i < M; i++)
-        vals[i] = forbidden_val(forbidden[i], clause_sizes[i]);
+// or := xor ('|' xor)*
+static int formula_or(FormulaParser *ps) {
+    int a = formula_xor(ps);
+    for (;;) {
+        if (a < 0) return -1;
+        formula_skip_space(ps);
+        if (*ps->p != '|') return a;
+        ps->p++;
+        int b = formula_xor(ps);
+        a = b < 0 ? -1 : formula_op(ps, '|', a, b);
+    }
+}
 
-    #pragma omp parallel
-    {
-        #pragma omp single nowait
-        parallel_quick_sort(vals, 0, M - 1);
+// implies := or ('->' implies)?, so a -> b -> c is a -> (b -> c)
+static int formula_implies(FormulaParser *ps) {
+    int a = formula_or(ps);
+    if (a < 0) return -1;
+    formula_skip_space(ps);
+    if (strncmp(ps->p, "->", 2)) return a;
+    ps->p += 2;
+    int b = formula_implies(ps);
+    return b < 0 ? -1 : formula_op(ps, '>', a, b);
+}
+
+// iff := implies ('<->' implies)*
+static int formula_iff(FormulaParser *ps) {
+    int a = formula_implies(ps);
+    for (;;) {
+        if (a < 0) return -1;
+        formula_skip_space(ps);
+        if (strncmp(ps->p, "<->", 3)) return a;
+        ps->p += 3;
+        int b = formula_implies(ps);
+        a = b < 0 ? -1 : formula_op(ps, '=', a, b);
     }
+}
 
-    // 1) Head: assignments from 0 up to vals[0]-1
-    bool any = false;
-    if (vals[0] > 0) {
-        any = true;
-        for (uint64_t v = 0; v < vals[0]; v++) {
-            for (int bb = clause_sizes[0]-1; bb >= 0; bb--) {
-                putchar((v >> bb) & 1 ? '1' : '0');
-                if (bb) putchar(' ');
-            }
-            putchar('\n');
-        }
+// Parse a formula line like "formula (1 | -2) & !3 -> 4". Variables are
+// numbered as in clauses. From tightest to loosest binding the operators
+// are '!' or '-' (not), '&', 'xor' or '^', '|', '->' and '<->'; '->' groups
+// to the right and the others to the left.
+static void parse_formula_line(char *line, int lineno) {
+    FormulaConstraint f = { NULL, 0, -1, 0, lineno };
+    FormulaParser ps = { line + strspn(line, " \t") + strlen("formula"), NULL, &f };
+    line[strcspn(line, "\r\n")] = '\0';
+
+    f.root = formula_iff(&ps);
+    formula_skip_space(&ps);
+    if (f.root >= 0 && *ps.p)
+        ps.err = *ps.p == ')' ? "unmatched ) in formula" : "unexpected character in formula";
+    if (ps.err) {
+        set_input_error_at(lineno, ps.err, line, (int)(ps.p - line) + 1);
+        free(f.node);
+        return;
+    }
+    if (formula_n == formula_cap) {
+        formula_cap = formula_cap ? formula_cap * 2 : 4;
+        formulas = realloc(formulas, formula_cap * sizeof(*formulas));
     }
+    formulas[formula_n++] = f;
+}
 
-    // 2) Gaps between consecutive forbidden values
-    for (int i = 0; i < M - 1; i++) {
-        uint64_t a = vals[i], b = vals[i+1];
-        if (b > a + 1) {
-            any = true;
-            for (uint64_t v = a + 1; v < b; v++) {
-                for (int bb = clause_sizes[0] - 1; bb >= 0; bb--) {
-                    putchar((v >> bb) & 1 ? '1' : '0');
-                    if (bb) putchar(' ');
-                }
-                putchar('\n');
-            }
+static bool formula_eval(const FormulaConstraint *f, int i, uint64_t v, int k) {
+    const FormulaNode *nd = &f->node[i];
+    switch (nd->op) {
+    case 'v': return (v >> (k - nd->a)) & 1;
+    case 'c': return nd->a;
+    case '!': return !formula_eval(f, nd->a, v, k);
+    default:  return formula_apply(nd->op, formula_eval(f, nd->a, v, k),
+                                   formula_eval(f, nd->b, v, k));
+    }
+}
+
+// Largest variable mentioned by any pending constraint
+static int constraints_max_var(int *line) {
+    int k = 0;
+    for (int i = 0; i < pb_n; i++)
+        for (int j = 0; j < pb[i].n; j++)
+            if (abs(pb[i].lit[j]) > k) { k = abs(pb[i].lit[j]); *line = pb[i].line; }
+    for (int i = 0; i < table_n; i++)
+        for (int j = 0; j < tables[i].n; j++)
+            if (tables[i].var[j] > k) { k = tables[i].var[j]; *line = tables[i].line; }
+    for (int i = 0; i < formula_n; i++)
+        if (formulas[i].max_var > k) { k = formulas[i].max_var; *line = formulas[i].line; }
+    return k;
+}
+
+// Whether v satisfies every pending constraint. Otherwise the line of the
+// first violated constraint is stored in *line.
+static bool constraints_hold(uint64_t v, int k, int *line) {
+    for (int i = 0; i < pb_n; i++)
+        if (!pb_holds(&pb[i], v, k)) { *line = pb[i].line; return false; }
+    for (int i = 0; i < table_n; i++)
+        if (!table_holds(&tables[i], v, k)) { *line = tables[i].line; return false; }
+    for (int i = 0; i < formula_n; i++)
+        if (!formula_eval(&formulas[i], formulas[i].root, v, k)) { *line = formulas[i].line; return false; }
+    return true;
+}
+
+// Store the line of every constraint v violates; returns how many there are
+static int violated_lines(uint64_t v, int k, int *lines) {
+    int n = 0;
+    for (int i = 0; i < pb_n; i++)
+        if (!pb_holds(&pb[i], v, k)) lines[n++] = pb[i].line;
+    for (int i = 0; i < table_n; i++)
+        if (!table_holds(&tables[i], v, k)) lines[n++] = tables[i].line;
+    for (int i = 0; i < formula_n; i++)
+        if (!formula_eval(&formulas[i], formulas[i].root, v, k)) lines[n++] = formulas[i].line;
+    return n;
+}
+
+// Where inputs are read from, and whether to prompt for each one
+static FILE *input_file;
+static bool  interactive = true;
+
+// Terminal colors for results, used only when stdout is a terminal
+#define ANSI_RED    "\033[31m"
+#define ANSI_GREEN  "\033[32m"
+#define ANSI_YELLOW "\033[33m"
+#define ANSI_DIM    "\033[2m"
+#define ANSI_RESET  "\033[0m"
+static bool color;
+
+// The escape sequence when colors are on, otherwise nothing
+static const char *paint(const char *code) {
+    return color ? code : "";
+}
+
+// Result of an input rejected or decided before solving: valid and
+// trivially unsatisfiable inputs set it, anything else is invalid
+static Result early_result;
+
+// Set once the input is exhausted before any line of a new input was read
+static bool end_of_input;
+
+// Whether a line holds nothing but whitespace
+static bool blank_line(const char *line) {
+    for (; *line; line++)
+        if (*line != ' ' && *line != '\t' && *line != '\r' && *line != '\n')
+            return false;
+    return true;
+}
+
+enum LineKind {
+    LINE_COMMENT,
+    LINE_CLAUSE,
+    LINE_PREFIX,
+    LINE_PB,
+    LINE_CARD,
+    LINE_TABLE,
+    LINE_FORMULA,
+    LINE_UNSUPPORTED
+};
+
+// Detect the format of an input line from its content
+static enum LineKind classify_line(const char *line, const char **unsupported) {
+    if (!strncmp(line, "p wcnf", 6)) {
+        *unsupported = "WCNF input is not supported";
+        return LINE_UNSUPPORTED;
+    }
+    if (!strncmp(line, "aag ", 4) || !strncmp(line, "aig ", 4)) {
+        *unsupported = "AIGER input is not supported";
+        return LINE_UNSUPPORTED;
+    }
+    if (!strncmp(line, "(set-", 5) || !strncmp(line, "(declare-", 9) ||
+        !strncmp(line, "(assert", 7)) {
+        *unsupported = "SMT-LIB input is not supported";
+        return LINE_UNSUPPORTED;
+    }
+    // DIMACS and OPB comments, DIMACS problem lines
+    if (line[0] == 'c' || line[0] == 'p' || line[0] == '*') return LINE_COMMENT;
+    if (!strncmp(line, "atmost", 6) || !strncmp(line, "atleast", 7)) return LINE_CARD;
+    if (!strncmp(line, "table", 5)) return LINE_TABLE;
+    if (!strncmp(line, "formula", 7)) return LINE_FORMULA;
+    if (strchr(line, 'x')) return LINE_PB;
+    // QDIMACS quantifier blocks
+    if ((line[0] == 'a' || line[0] == 'e') && (line[1] == ' ' || line[1] == '\t'))
+        return LINE_PREFIX;
+    return LINE_CLAUSE;
+}
+
+// Whether a line kind may appear in the --format selected input
+static bool format_allows(enum LineKind kind) {
+    if (!strcmp(opt.format, "dimacs"))  return kind == LINE_CLAUSE;
+    if (!strcmp(opt.format, "qdimacs")) return kind == LINE_CLAUSE || kind == LINE_PREFIX;
+    if (!strcmp(opt.format, "opb"))     return kind == LINE_PB;
+    return true;
+}
+
+// Parse the literals of a clause line, skipping the DIMACS terminator 0.
+// Returns false when a token is not an integer.
+static bool parse_clause_line(const char *line, Clause *c) {
+    int *temp = NULL, tcap = 0, tsz = 0;
+    const char *p = line;
+    bool ok = true;
+    for (;;) {
+        p += strspn(p, " \t\r\n");
+        if (!*p) break;
+        char *end;
+        long lit = strtol(p, &end, 10);
+        if (end == p || (*end && !strchr(" \t\r\n", *end))) ok = false;
+        p += strcspn(p, " \t\r\n");
+        if (!lit) continue;
+        if (tsz == tcap) {
+            tcap = tcap ? tcap * 2 : 4;
+            temp = realloc(temp, tcap * sizeof(int));
         }
+        temp[tsz++] = lit;
     }
-    // 3) Tail: assignments after vals[M-1]
-    uint64_t last = vals[M-1];
-    int C0 = clause_sizes[0];
-    uint64_t maxv = ((uint64_t)1 << C0) - 1;
-    if (last < maxv) {
-        any = true;
-        for (uint64_t v = last + 1; v <= maxv; v++) {
-            for (int bb = C0 -1; bb >= 0; bb--) {
-                putchar((v >> bb) & 1 ? '1' : '0');
-                if (bb) putchar(' ');
-            }
-            putchar('\n');
+    c->orig = temp;
+    c->sz   = tsz;
+    return ok;
+}
+
+// Number of clause lines in the input being solved
+static int clause_lines;
+
+static Clause* read_clause(int *out_M) {
+    Clause *C = NULL;
+    char  **text = NULL;
+    int    *text_line = NULL;
+    int cap = 0, M = 0;
+    char *line = NULL;
+    size_t linecap = 0;
+    ssize_t linelen;
+    int lineno = 0;
+
+    if (interactive) printf("Enter clause(s) and blank line to finish:\n");
+    end_of_input = true;
+    while ((linelen = getline(&line, &linecap, input_file)) != -1) {
+        end_of_input = false;
+        if (blank_line(line)) break;
+        lineno++;
+        const char *unsupported = NULL;
+        // Indentation does not change what kind of line it is
+        char *start = line + strspn(line, " \t");
+        enum LineKind kind = classify_line(start, &unsupported);
+        if (kind == LINE_COMMENT) continue;
+        if (kind == LINE_UNSUPPORTED) {
+            set_input_error(lineno, unsupported);
+            continue;
+        }
+        if (!format_allows(kind)) {
+            set_input_error(lineno, "line does not match the selected --format");
+            continue;
+        }
+        if (kind == LINE_TABLE) {
+            parse_table_line(start, lineno);
+            continue;
+        }
+        if (kind == LINE_FORMULA) {
+            parse_formula_line(line, lineno);
+            continue;
+        }
+        if (kind == LINE_CARD) {
+            parse_card_line(start, lineno);
+            continue;
+        }
+        if (kind == LINE_PB) {
+            parse_pb_line(start, lineno);
+            continue;
+        }
+        if (kind == LINE_PREFIX) {
+            parse_prefix_line(start, lineno);
+            continue;
+        }
+        if (M == cap) {
+            cap  = cap ? cap * 2 : 4;
+            C         = realloc(C, cap * sizeof(Clause));
+            text      = realloc(text, cap * sizeof(char *));
+            text_line = realloc(text_line, cap * sizeof(int));
         }
+        // Keep the line itself; getline allocates a fresh buffer next time
+        text_line[M] = lineno;
+        text[M++]    = line;
+        line      = NULL;
+        linecap   = 0;
     }
+    free(line);
 
-    free(vals);
-    return any;
+    // Clause lines are independent, so their literals are parsed in parallel.
+    // The first line with a malformed literal is reported.
+    int bad = M;
+    #pragma omp parallel for schedule(dynamic, 1024) reduction(min:bad)
+    for (int i = 0; i < M; i++) {
+        if (!parse_clause_line(text[i], &C[i])) bad = i;
+        free(text[i]);
+    }
+    if (bad < M) set_input_error(text_line[bad], "malformed literal");
+    for (int i = 0; i < M; i++) {
+        C[i].idx  = i + 1;
+        C[i].line = text_line[i];
+    }
+    clause_lines = M;
+    free(text);
+    free(text_line);
+    *out_M = M;
+    return C;
 }
 
-int main(void) {
-    omp_set_num_threads(omp_get_max_threads());
-    while (1) {
-        int M;
-        Clause *clause = read_clause(&M);
+// Wall-clock deadline of the current solve, 0 when there is none
+static double deadline;
+static bool   timed_out;
 
-        if (!I_process_clause(clause, M))
-            continue;
+// Seconds between --progress lines
+#define PROGRESS_INTERVAL 1.0
+
+// --progress state of the current solve: when it started, when the next
+// line is due, what it is doing and how many models it has printed
+static double      progress_started, progress_next;
+static const char *progress_phase;
+static uint64_t    models_printed;
+
+static void report_progress(void) {
+    double now = omp_get_wtime();
+    if (now < progress_next) return;
+    #pragma omp critical(progress)
+    if (now >= progress_next) {
+        fprintf(stderr, "Progress, %.0f s elapsed, %s, %" PRIu64 " model(s) printed\n",
+                now - progress_started, progress_phase, models_printed);
+        progress_next = now + PROGRESS_INTERVAL;
+    }
+}
+
+// Whether the --timeout deadline has passed; stays true once it has.
+// Long loops call this regularly, so it also drives --progress.
+static bool time_up(void) {
+    if (opt.progress) report_progress();
+    if (!timed_out && deadline && omp_get_wtime() > deadline)
+        __atomic_store_n(&timed_out, true, __ATOMIC_RELAXED);
+    return __atomic_load_n(&timed_out, __ATOMIC_RELAXED);
+}
+
+// Compile pending pseudo-Boolean and table constraints into clauses, one clause
+// for every assignment that violates some constraint. The constraints are
+// kept until the input is solved so models can be verified against them.
+static bool compile_constraints(Clause **pclause, int *pM) {
+    Clause *C = *pclause;
+    int M = *pM;
+    if (!pb_n && !table_n && !formula_n && !input_error_line) return true;
 
-        unsigned char **forbidden   = malloc(M * sizeof(*forbidden));
-        int            *clause_sizes = malloc(M * sizeof(*clause_sizes));
-        bool            early_unsat = false;
+    int max_line = 0;
+    int max_var  = constraints_max_var(&max_line);
+    int k = M > 0 ? C[0].sz : max_var;
 
+    bool ok = true;
+    if (input_error_line) {
         printf("Result:\n");
-        #pragma omp parallel for schedule(dynamic)
-        for (int i = 0; i < M; i++) {
-            clause_sizes[i] = clause[i].sz;
-            forbidden[i]    = malloc(clause_sizes[i]);
-            if (!__atomic_load_n(&early_unsat, __ATOMIC_RELAXED))
-                II_process_clause(&clause[i], clause_sizes[i], forbidden[i], &early_unsat, i);
+        if (!input_error_col) {
+            printf("Invalid input, %s on line %d\n\n", input_error, input_error_line);
+        } else {
+            printf("Invalid input, %s on line %d, column %d\n", input_error,
+                   input_error_line, input_error_col);
+            printf("  %s\n  ", input_error_text);
+            // Keep tabs so the caret lines up under the offending character
+            for (int i = 0; i < input_error_col - 1 && input_error_text[i]; i++)
+                putchar(input_error_text[i] == '\t' ? '\t' : ' ');
+            printf("^\n\n");
         }
+        ok = false;
+    }
+    if (ok && max_var > k) {
+        printf("Result:\n");
+        printf("Invalid input, constraint on line %d uses variable %d but clauses have %d literals\n\n",
+               max_line, max_var, k);
+        ok = false;
+    }
+    if (ok && k > MAX_COMPILE_VARS) {
+        printf("Result:\n");
+        printf("Invalid input, constraints over more than %d variables are not supported\n\n",
+               MAX_COMPILE_VARS);
+        ok = false;
+    }
+    if (!ok) {
+        for (int i = 0; i < M; i++) free(C[i].orig);
+        free(C);
+        free_constraints();
+        free_qbf_prefix();
+        *pclause = NULL;
+        *pM = 0;
+        return false;
+    }
 
-        if (!early_unsat) {
-           /* printf("Forbidden matrix (%d clauses):\n", M);
-            for (int i = 0; i < M; i++) {
-                for (int j = 0; j < clause_sizes[i]; j++)
-                    printf("%d ", forbidden[i][j]);
-                printf("\n");
-            }
-            printf("\n");*/
-            bool has_any = get_assignments(M, forbidden, clause_sizes);
-            if (!has_any) printf("Unsatisfiable, no head or gap or tail of the SAT instance, or the input is invalid\n");
+    int cap = M;
+    uint64_t count = (uint64_t)1 << k;
+    for (uint64_t v = 0; v < count; v++) {
+        int line;
+        if (!(v & 0xFFF) && time_up()) break;
+        if (constraints_hold(v, k, &line)) continue;
+        if (M == cap) {
+            cap = cap ? cap * 2 : 4;
+            C = realloc(C, cap * sizeof(Clause));
         }
+        C[M].orig = malloc(k * sizeof(int));
+        C[M].sz   = k;
+        C[M].idx  = ++clause_lines;
+        C[M].line = line;
+        for (int i = 1; i <= k; i++)
+            C[M].orig[i - 1] = ((v >> (k - i)) & 1) ? -i : i;
+        M++;
+    }
+    *pclause = C;
+    *pM = M;
 
-        #pragma omp parallel for
-        for (int i = 0; i < M; i++) {
-            free(clause[i].orig);
-            free(forbidden[i]);
+    // No clauses and nothing violated: every assignment is a model
+    if (!M && !timed_out) {
+        printf("Result:\n");
+        printf("%sValid, every assignment of the %d variable(s) satisfies the input%s\n\n",
+               paint(ANSI_GREEN), k, paint(ANSI_RESET));
+        early_result = RESULT_SAT;
+        free(C);
+        free_constraints();
+        free_qbf_prefix();
+        *pclause = NULL;
+        return false;
+    }
+    return true;
+}
+
+static bool I_process_clause(Clause *clause, int M) {
+    if (M == 0) {
+        printf("Result:\n");
+        printf("No input\n\n");
+        free(clause);
+        return false;
+    }
+    // An empty clause cannot be satisfied by any assignment
+    for (int i = 0; i < M; i++) {
+        if (clause[i].sz == 0) {
+            printf("Result:\n");
+            printf("%sUnsatisfiable, clause (%d) is empty%s\n\n",
+                   paint(ANSI_RED), clause[i].idx, paint(ANSI_RESET));
+            early_result = RESULT_UNSAT;
+            for (int j = 0; j < M; j++)
+                free(clause[j].orig);
+            free(clause);
+            return false;
+        }
+    }
+    int first_sz = clause[0].sz;
+    // Each clause forbids one assignment stored in 64 bits
+    if (first_sz > 64) {
+        printf("Result:\n");
+        printf("Invalid input, clauses have %d literals but at most 64 are supported\n\n",
+               first_sz);
+        for (int j = 0; j < M; j++)
+            free(clause[j].orig);
+        free(clause);
+        return false;
+    }
+    for (int i = 1; i < M; i++) {
+        if (clause[i].sz != first_sz) {
+            printf("Result:\n");
+            // Sizes count distinct literals, repeated ones were removed
+            printf(
+              "Invalid input, clause (%d) has %d different literal(s) but clause (%d) has %d\n\n",
+              clause[0].idx, first_sz, clause[i].idx, clause[i].sz
+            );
+            // clean up
+            #pragma omp parallel for
+            for (int j = 0; j < M; j++)
+                free(clause[j].orig);
+            free(clause);
+            return false;
+        }
+    }
+    // Literals are sorted by variable and distinct, so a clause covers
+    // variables 1..k exactly when its last literal is on variable k
+    for (int i = 0; i < M; i++) {
+        int last = abs(clause[i].orig[first_sz - 1]);
+        if (last != first_sz) {
+            printf("Result:\n");
+            printf("Invalid input, clause (%d) uses variable %d but clauses have %d literals\n\n",
+                   clause[i].idx, last, first_sz);
+            for (int j = 0; j < M; j++)
+                free(clause[j].orig);
+            free(clause);
+            return false;
+        }
+    }
+    return true;
+}
+
+static int cmp_abs_int(const void *a, const void *b) {
+    int x = abs(*(const int *)a), y = abs(*(const int *)b);
+    return (x > y) - (x < y);
+}
+
+// Remove repeated literals within clauses, drop clauses containing both
+// x and -x, which every assignment satisfies, and sort the literals of
+// the rest by variable: literal order does not matter, but each position
+// of a forbidden row stands for one variable. Returns false when every
+// clause was a tautology and nothing else constrains the input.
+static bool simplify_clauses(Clause *clause, int *pM) {
+    int M = *pM, kept = 0, dup = 0, taut = 0, i;
+    for (i = 0; i < M; i++) {
+        if (!(i & 0xFFF) && time_up()) break;
+        Clause *c = &clause[i];
+        bool tautology = false;
+        int sz = 0;
+        for (int j = 0; j < c->sz && !tautology; j++) {
+            bool seen = false;
+            for (int t = 0; t < sz; t++) {
+                seen      |= c->orig[t] == c->orig[j];
+                tautology |= c->orig[t] == -c->orig[j];
+            }
+            if (seen) dup++;
+            else c->orig[sz++] = c->orig[j];
+        }
+        if (tautology) {
+            if (opt.verbose)
+                printf("Simplified, clause (%d) is a tautology and was dropped\n", c->idx);
+            taut++;
+            free(c->orig);
+            continue;
+        }
+        c->sz = sz;
+        qsort(c->orig, sz, sizeof(int), cmp_abs_int);
+        clause[kept++] = *c;
+    }
+    // Past the --timeout deadline the rest is kept as read; the solve stops
+    while (i < M) clause[kept++] = clause[i++];
+    if (opt.verbose && (dup || taut))
+        printf("Simplified, removed %d duplicate literal(s) and %d tautological clause(s)\n",
+               dup, taut);
+    *pM = kept;
+
+    if (M && !kept && !pb_n && !table_n && !formula_n && !input_error_line) {
+        printf("Result:\n");
+        printf("%sValid, every clause is a tautology%s\n\n", paint(ANSI_GREEN), paint(ANSI_RESET));
+        early_result = RESULT_SAT;
+        free(clause);
+        return false;
+    }
+    return true;
+}
+
+// Clauses being compared while reporting redundancy
+static const Clause *redundant_src;
+
+// Order clause indices by literal sequence, then by position in the input
+static int cmp_clause_idx(const void *a, const void *b) {
+    int i = *(const int *)a, j = *(const int *)b;
+    int c = memcmp(redundant_src[i].orig, redundant_src[j].orig,
+                   redundant_src[i].sz * sizeof(int));
+    if (c) return c;
+    return (i > j) - (i < j);
+}
+
+// Report duplicated and subsumed clauses before solving: their number, and
+// under --verbose each one in input order with the clause it repeats
+static void report_redundant_clauses(const Clause *clause, int M) {
+    // Literal positions are variables and all clauses have the same size,
+    // so a clause is subsumed exactly when an earlier clause repeats it
+    int sz = clause[0].sz;
+    if (time_up()) return;
+    int *order = malloc(M * sizeof(*order));
+    if (!order) { perror("malloc"); exit(1); }
+    for (int i = 0; i < M; i++) order[i] = i;
+
+    redundant_src = clause;
+    qsort(order, M, sizeof(*order), cmp_clause_idx);
+    redundant_src = NULL;
+
+    // The first clause of each group is the one that is kept; kept_by
+    // maps each repeated clause to it, -1 for clauses that are kept
+    int *kept_by = malloc(M * sizeof(*kept_by));
+    if (!kept_by) { perror("malloc"); exit(1); }
+    int first = 0, redundant = 0;
+    kept_by[order[0]] = -1;
+    for (int g = 1; g < M; g++) {
+        int i = order[first], j = order[g];
+        kept_by[j] = -1;
+        if (memcmp(clause[i].orig, clause[j].orig, sz * sizeof(int))) {
+            first = g;
+            continue;
+        }
+        kept_by[j] = i;
+        redundant++;
+    }
+    free(order);
+
+    if (redundant && opt.verbose) {
+        for (int j = 0; j < M; j++) {
+            if (!(j & 0xFFF) && time_up()) break;
+            if (kept_by[j] >= 0)
+                printf("Redundant, clause (%d) duplicates and is subsumed by clause (%d)\n",
+                       clause[j].idx, clause[kept_by[j]].idx);
+        }
+    } else if (redundant) {
+        printf("Redundant, %d clause(s) duplicate earlier ones, --verbose lists them\n",
+               redundant);
+    }
+    free(kept_by);
+}
+
+// Process one clause: record forbidden bits per literal position.
+// Tautologies were dropped by simplify_clauses, so every clause has one.
+static void II_process_clause(const Clause *c,
+                           int row_len,
+                           unsigned char *out_row)
+{
+    // Mark forbidden: 1 for negative literal, 0 for positive
+    for (int i = 0; i < row_len; i++)
+        out_row[i] = (c->orig[i] < 0) ? 1 : 0;
+}
+
+// Convert a row of length C to a number
+static uint64_t forbidden_val(const unsigned char *row, int C) {
+    int s = 0;
+    while (s < C && row[s] == 0) s++;
+    if (s == C) return 0;
+    uint64_t v = 0;
+    for (int j = s; j < C; j++)
+        v = (v << 1) | row[j];
+    return v;
+}
+
+// Ranges below this size are sorted without spawning tasks
+#define SORT_TASK_CUTOFF 4096
+
+static void swap_u64(uint64_t *a, uint64_t *b) {
+    uint64_t tmp = *a; *a = *b; *b = tmp;
+}
+
+// Three-way partition around a median-of-three pivot. Afterwards
+// arr[low..*lt-1] < pivot, arr[*lt..*gt] == pivot, arr[*gt+1..high] > pivot,
+// so sorted input and runs of equal values stay O(n log n).
+static void partition_serial(uint64_t arr[], int low, int high, int *lt, int *gt) {
+    int mid = low + (high - low) / 2;
+    if (arr[mid]  < arr[low]) swap_u64(&arr[mid],  &arr[low]);
+    if (arr[high] < arr[low]) swap_u64(&arr[high], &arr[low]);
+    if (arr[high] < arr[mid]) swap_u64(&arr[high], &arr[mid]);
+    uint64_t pivot = arr[mid];
+
+    int i = low, l = low, g = high;
+    while (i <= g) {
+        if (arr[i] < pivot)      swap_u64(&arr[i++], &arr[l++]);
+        else if (arr[i] > pivot) swap_u64(&arr[i], &arr[g--]);
+        else                     i++;
+    }
+    *lt = l;
+    *gt = g;
+}
+
+// Parallel quicksort tasks
+void parallel_quick_sort(uint64_t *arr, int low, int high) {
+    if (low < high && !time_up()) {
+        int lt, gt;
+        partition_serial(arr, low, high, &lt, &gt);
+        if (high - low < SORT_TASK_CUTOFF) {
+            parallel_quick_sort(arr, low, lt - 1);
+            parallel_quick_sort(arr, gt + 1, high);
+            return;
+        }
+        #pragma omp task shared(arr)
+        parallel_quick_sort(arr, low, lt - 1);
+        #pragma omp task shared(arr)
+        parallel_quick_sort(arr, gt + 1, high);
+        #pragma omp taskwait
+    }
+}
+
+// Map each clause's forbidden row to a numeric value, sorted ascending.
+// The order is incomplete when the sort was cut short by --timeout.
+static uint64_t *sorted_forbidden_vals(int M,
+                                       unsigned char **forbidden,
+                                       int *clause_sizes)
+{
+    uint64_t *vals = malloc((size_t)M * sizeof *vals);
+    if (!vals) { perror("malloc"); exit(1); }
+
+    #pragma omp parallel for
+    for (int i = 0; i < M; i++)
+        vals[i] = forbidden_val(forbidden[i], clause_sizes[i]);
+
+    progress_phase = "sorting forbidden values";
+    #pragma omp parallel
+    {
+        #pragma omp single nowait
+        parallel_quick_sort(vals, 0, M - 1);
+    }
+    progress_phase = "searching the gaps";
+    return vals;
+}
+
+// Sorted forbidden values with duplicates removed; *n receives the count
+static uint64_t *distinct_forbidden_vals(int M, unsigned char **forbidden,
+                                         int *clause_sizes, int *n)
+{
+    uint64_t *vals = sorted_forbidden_vals(M, forbidden, clause_sizes);
+    int d = 0;
+    for (int i = 0; i < M; i++)
+        if (!d || vals[i] != vals[d - 1]) vals[d++] = vals[i];
+    *n = d;
+    return vals;
+}
+
+// Whether v is one of the n sorted distinct forbidden values
+static bool is_forbidden(const uint64_t *vals, int n, uint64_t v) {
+    int lo = 0, hi = n;
+    while (lo < hi) {
+        int mid = lo + (hi - lo) / 2;
+        if (vals[mid] < v) lo = mid + 1;
+        else hi = mid;
+    }
+    return lo < n && vals[lo] == v;
+}
+
+// Decide a quantified formula over the distinct forbidden values by
+// branching on variables in prefix order. Outer existential choices on
+// the winning path are recorded in *witness.
+static bool qbf_eval(const uint64_t *vals, int nvals, int k,
+                     const int *order, const char *quant, int outer,
+                     int depth, uint64_t mask, uint64_t value,
+                     uint64_t *witness)
+{
+    if (time_up()) return false;
+
+    // Stop early when no forbidden value, or every completion, is left
+    int consistent = 0;
+    for (int i = 0; i < nvals; i++)
+        if ((vals[i] & mask) == value) consistent++;
+    if (!consistent) return true;
+    if (k - depth < 31 && consistent == (1 << (k - depth))) return false;
+
+    uint64_t bit = (uint64_t)1 << (k - order[depth]);
+    bool exists = quant[depth] == 'e';
+    for (int b = 0; b < 2; b++) {
+        uint64_t v = b ? value | bit : value;
+        bool r = qbf_eval(vals, nvals, k, order, quant, outer,
+                          depth + 1, mask | bit, v, witness);
+        if (exists && r) {
+            if (depth < outer) *witness = (*witness & ~bit) | (v & bit);
+            return true;
+        }
+        if (!exists && !r) return false;
+    }
+    return !exists;
+}
+
+// Evaluate the quantified formula read from the QDIMACS prefix
+static Result solve_qbf(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    for (int i = 0; i < qbf_n; i++) {
+        if (qbf_order[i] > k) {
+            printf("Invalid input, quantifier block uses variable %d but clauses have %d literals\n",
+                   qbf_order[i], k);
+            return RESULT_INVALID;
+        }
+    }
+
+    int nvals;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &nvals);
+
+    // Free variables are existential and outermost
+    int  *order = malloc(k * sizeof(*order));
+    char *quant = malloc(k);
+    int   n = 0;
+    for (int v = 1; v <= k; v++) {
+        if (v < qbf_vars && qbf_quant[v]) continue;
+        order[n] = v; quant[n] = 'e'; n++;
+    }
+    for (int i = 0; i < qbf_n; i++) {
+        order[n] = qbf_order[i]; quant[n] = qbf_quant[qbf_order[i]]; n++;
+    }
+    int outer = 0;
+    while (outer < k && quant[outer] == 'e') outer++;
+    progress_phase = "branching on the quantifier prefix";
+
+    uint64_t witness = 0;
+    bool holds = !time_up() &&
+                 qbf_eval(vals, nvals, k, order, quant, outer, 0, 0, 0, &witness);
+    Result r = timed_out ? RESULT_UNKNOWN : holds ? RESULT_SAT : RESULT_UNSAT;
+    if (r == RESULT_SAT) {
+        printf("%sTrue, the quantified formula holds%s\n", paint(ANSI_GREEN), paint(ANSI_RESET));
+        if (outer) {
+            printf("Outer existential assignment:");
+            for (int i = 0; i < outer; i++) {
+                int v = order[i];
+                printf(" %d", (witness >> (k - v)) & 1 ? v : -v);
+            }
+            printf("\n");
+        }
+    } else if (r == RESULT_UNSAT) {
+        printf("%sFalse, the quantified formula does not hold%s\n", paint(ANSI_RED), paint(ANSI_RESET));
+    }
+    free(order);
+    free(quant);
+    free(vals);
+    return r;
+}
+
+// Print one assignment of C variables as a row of bits
+static void print_assignment(uint64_t v, int C) {
+    for (int bb = C - 1; bb >= 0; bb--) {
+        putchar((v >> bb) & 1 ? '1' : '0');
+        if (bb) putchar(' ');
+    }
+    putchar('\n');
+}
+
+// Clauses of the current solve: the first n_input_clauses as read, then
+// those compiled from constraints
+static const Clause *input_clauses;
+static int           n_input_clauses;
+
+// Check a model against the input as written: each clause by its literal
+// values and each constraint directly, independent of the forbidden-row
+// path. Exits on a mismatch, since the reported result would be wrong.
+static void verify_model(uint64_t v, int k) {
+    for (int i = 0; i < n_input_clauses; i++) {
+        bool sat = false;
+        for (int j = 0; j < input_clauses[i].sz && !sat; j++) {
+            int lit = input_clauses[i].orig[j], var = abs(lit);
+            sat = var <= k && (((v >> (k - var)) & 1) == (lit > 0));
+        }
+        if (!sat) {
+            printf("Verification failed, the assignment below violates clause (%d)\n",
+                   input_clauses[i].idx);
+            print_assignment(v, k);
+            exit(2);
+        }
+    }
+    int line;
+    if (!constraints_hold(v, k, &line)) {
+        printf("Verification failed, the assignment below violates the constraint on line %d\n",
+               line);
+        print_assignment(v, k);
+        exit(2);
+    }
+}
+
+// Models of the current solve under --output json, printed with the result
+static uint64_t *json_models;
+static size_t    json_n, json_cap;
+static int       json_vars;
+// --prime result: variables in the mask are fixed to their value bits
+static bool      json_implicant;
+static uint64_t  json_implicant_mask, json_implicant_val;
+
+// Print an assignment of C variables as a result: collected for the JSON
+// object under --output json, otherwise a colored row of bits
+static void emit_assignment(uint64_t v, int C) {
+    models_printed++;
+    if (opt.json) {
+        if (json_n == json_cap) {
+            json_cap    = json_cap ? json_cap * 2 : 16;
+            json_models = realloc(json_models, json_cap * sizeof(*json_models));
+        }
+        json_models[json_n++] = v;
+        json_vars = C;
+        return;
+    }
+    fputs(paint(ANSI_GREEN), stdout);
+    print_assignment(v, C);
+    fputs(paint(ANSI_RESET), stdout);
+}
+
+// Print a satisfying assignment, verifying it first under --verify
+static void print_model(uint64_t v, int k) {
+    if (opt.verify) verify_model(v, k);
+    emit_assignment(v, k);
+}
+
+// Print assignments lo..hi, counting them against --limit.
+// Returns false once the limit or the --timeout deadline has been reached.
+static bool print_range(uint64_t lo, uint64_t hi, int C, uint64_t *printed) {
+    for (uint64_t v = lo; ; v++) {
+        if (opt.limit && *printed == opt.limit) return false;
+        if (!(*printed & 0xFFF) && time_up()) return false;
+        print_model(v, C);
+        (*printed)++;
+        if (v == hi) return true;
+    }
+}
+
+// Find missing assignments across all clauses
+static Result get_assignments(int M,
+                            unsigned char **forbidden,
+                            int *clause_sizes)
+{
+    uint64_t *vals = sorted_forbidden_vals(M, forbidden, clause_sizes);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+    int C0 = clause_sizes[0];
+    uint64_t printed = 0;
+    bool more = true;
+
+    // 1) Head: assignments from 0 up to vals[0]-1
+    bool any = false;
+    if (vals[0] > 0) {
+        any = true;
+        more = print_range(0, vals[0] - 1, C0, &printed);
+    }
+
+    // 2) Gaps between consecutive forbidden values
+    for (int i = 0; more && i < M - 1; i++) {
+        uint64_t a = vals[i], b = vals[i+1];
+        if (b > a + 1) {
+            any = true;
+            more = print_range(a + 1, b - 1, C0, &printed);
+        }
+    }
+    // 3) Tail: assignments after vals[M-1]
+    uint64_t last = vals[M-1];
+    uint64_t maxv = C0 == 64 ? UINT64_MAX : ((uint64_t)1 << C0) - 1;
+    if (more && last < maxv) {
+        any = true;
+        more = print_range(last + 1, maxv, C0, &printed);
+    }
+    if (!more)
+        printf("Stopped after %" PRIu64 " assignment(s), the %s limit was reached\n",
+               printed, timed_out ? "time" : "assignment");
+
+    free(vals);
+    return any ? RESULT_SAT : RESULT_UNSAT;
+}
+
+// A model whose projection onto the --project variables is p: the first
+// completion of p that is not among the n sorted distinct forbidden values.
+// At most one more completion than p has forbidden ones is tried.
+static uint64_t projection_witness(uint64_t p, const uint64_t *vals, int n, int k) {
+    int P = opt.n_project;
+    uint64_t fixed = 0, free_mask = k == 64 ? UINT64_MAX : ((uint64_t)1 << k) - 1;
+    for (int j = 0; j < P; j++) {
+        uint64_t bit = (uint64_t)1 << (k - opt.project[j]);
+        free_mask &= ~bit;
+        if ((p >> (P - 1 - j)) & 1) fixed |= bit;
+    }
+    // Step through the free bits as a counter, lowest variable last
+    uint64_t v = fixed;
+    while (is_forbidden(vals, n, v))
+        v = (((v | ~free_mask) + 1) & free_mask) | fixed;
+    return v;
+}
+
+// Print the satisfying assignments projected onto the --project variables,
+// each projection once. A projection has a model unless every one of its
+// 2^(k-P) completions is forbidden.
+static Result get_projected_assignments(int M,
+                                      unsigned char **forbidden,
+                                      int *clause_sizes)
+{
+    int k = clause_sizes[0], P = opt.n_project;
+    for (int i = 0; i < P; i++) {
+        if (opt.project[i] > k) {
+            printf("Invalid input, --project uses variable %d but clauses have %d literals\n",
+                   opt.project[i], k);
+            return RESULT_INVALID;
+        }
+    }
+
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+    json_vars = P;
+
+    // Key of each forbidden value: its bits on the projected variables
+    uint64_t *keys = malloc((n ? n : 1) * sizeof(*keys));
+    if (!keys) { perror("malloc"); exit(1); }
+    #pragma omp parallel for
+    for (int i = 0; i < n; i++) {
+        uint64_t key = 0;
+        for (int j = 0; j < P; j++)
+            key = (key << 1) | ((vals[i] >> (k - opt.project[j])) & 1);
+        keys[i] = key;
+    }
+    qsort(keys, n, sizeof(*keys), cmp_u64);
+
+    uint64_t completions = k - P < 63 ? (uint64_t)1 << (k - P) : UINT64_MAX;
+    uint64_t count = (uint64_t)1 << P, printed = 0;
+    bool any = false;
+    int i = 0;
+    for (uint64_t p = 0; p < count; p++) {
+        uint64_t blocked = 0;
+        while (i < n && keys[i] == p) { blocked++; i++; }
+        if (blocked == completions) continue;
+        if (opt.limit && printed == opt.limit) {
+            printf("Stopped after %" PRIu64 " assignment(s), the limit was reached\n", printed);
+            break;
+        }
+        if (time_up()) {
+            printf("Stopped after %" PRIu64 " assignment(s), the time limit was reached\n", printed);
+            break;
+        }
+        any = true;
+        if (opt.verify) verify_model(projection_witness(p, vals, n, k), k);
+        emit_assignment(p, P);
+        printed++;
+    }
+    free(keys);
+    free(vals);
+    return any ? RESULT_SAT : RESULT_UNSAT;
+}
+
+// Existentially quantify the --forget variables away and print the result
+// as clauses over the remaining variables. An assignment to those is
+// excluded exactly when all 2^F completions of it are forbidden, and each
+// excluded assignment becomes one clause.
+static Result forget_variables(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0], F = opt.n_forget;
+    for (int i = 0; i < F; i++) {
+        if (opt.forget[i] > k) {
+            printf("Invalid input, --forget uses variable %d but clauses have %d literals\n",
+                   opt.forget[i], k);
+            return RESULT_INVALID;
+        }
+    }
+    // Remaining variables in increasing order
+    int *keep = malloc(k * sizeof(int)), P = 0;
+    for (int v = 1; v <= k; v++) {
+        bool gone = false;
+        for (int i = 0; i < F; i++) gone |= opt.forget[i] == v;
+        if (!gone) keep[P++] = v;
+    }
+
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(keep);
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+    #pragma omp parallel for
+    for (int i = 0; i < n; i++) {
+        uint64_t key = 0;
+        for (int j = 0; j < P; j++)
+            key = (key << 1) | ((vals[i] >> (k - keep[j])) & 1);
+        vals[i] = key;
+    }
+    qsort(vals, n, sizeof(*vals), cmp_u64);
+
+    uint64_t completions = (uint64_t)1 << F, printed = 0;
+    bool limited = false;
+    printf("Clauses over the remaining %d variable(s):\n", P);
+    for (int i = 0; i < n; ) {
+        int j = i;
+        while (j < n && vals[j] == vals[i]) j++;
+        uint64_t key = vals[i], blocked = j - i;
+        i = j;
+        if (blocked != completions) continue;
+        if (opt.limit && printed == opt.limit) {
+            printf("Stopped after %" PRIu64 " clause(s), the limit was reached\n", printed);
+            limited = true;
+            break;
+        }
+        for (int t = 0; t < P; t++)
+            printf("%d ", (key >> (P - 1 - t)) & 1 ? -keep[t] : keep[t]);
+        printf("0\n");
+        printed++;
+    }
+    if (!printed) printf("None\n");
+    free(keep);
+    free(vals);
+    // The projection has no model only when every assignment is excluded
+    return P < 64 && printed == (uint64_t)1 << P && !limited ? RESULT_UNSAT : RESULT_SAT;
+}
+
+// xorshift64* state for sampling
+static uint64_t rng_state;
+
+static uint64_t rng_next(void) {
+    if (!rng_state) rng_state = (uint64_t)time(NULL) * 0x9E3779B97F4A7C15ULL | 1;
+    rng_state ^= rng_state >> 12;
+    rng_state ^= rng_state << 25;
+    rng_state ^= rng_state >> 27;
+    return rng_state * 0x2545F4914F6CDD1DULL;
+}
+
+// Uniform random number in [0, n)
+static uint64_t rng_below(uint64_t n) {
+    uint64_t limit = UINT64_MAX - UINT64_MAX % n, r;
+    do r = rng_next(); while (r >= limit);
+    return r % n;
+}
+
+// Print --sample assignments drawn uniformly and independently from the
+// models. The r-th model is r plus the number of forbidden values that
+// precede it, found by binary search over the distinct sorted values.
+static Result sample_assignments(int M,
+                               unsigned char **forbidden,
+                               int *clause_sizes)
+{
+    int k = clause_sizes[0];
+    if (k > 63) {
+        printf("Invalid input, sampling supports at most 63 variables\n");
+        return RESULT_INVALID;
+    }
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+
+    uint64_t models = ((uint64_t)1 << k) - n;
+    if (!models) {
+        free(vals);
+        return RESULT_UNSAT;
+    }
+    for (uint64_t s = 0; s < opt.sample; s++) {
+        uint64_t r = rng_below(models);
+        // Count forbidden values i with vals[i] - i <= r
+        int lo = 0, hi = n;
+        while (lo < hi) {
+            int mid = lo + (hi - lo) / 2;
+            if (vals[mid] - mid <= r) lo = mid + 1;
+            else hi = mid;
+        }
+        print_model(r + lo, k);
+    }
+    free(vals);
+    return RESULT_SAT;
+}
+
+// Flips tried by --engine local before it gives up without a --timeout
+#define LOCAL_MAX_FLIPS 100000
+// Percentage of local search flips that pick a random variable
+#define LOCAL_NOISE 20
+
+// WalkSAT over the forbidden values. A clause is falsified only by the one
+// assignment it forbids, so flipping any variable satisfies it; the variable
+// is picked to break the fewest other clauses, or at random with LOCAL_NOISE
+// percent probability. Each flip costs one pass over the clauses and no
+// sorting is done, but an exhausted search proves nothing.
+static Result local_search(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    uint64_t *vals = malloc((size_t)M * sizeof *vals);
+    if (!vals) { perror("malloc"); exit(1); }
+    #pragma omp parallel for
+    for (int i = 0; i < M; i++)
+        vals[i] = forbidden_val(forbidden[i], clause_sizes[i]);
+
+    int *breaks = malloc(k * sizeof(int));
+    uint64_t a = rng_next() >> (64 - k);
+    progress_phase = "flipping variables in local search";
+    for (long flip = 0; deadline || flip < LOCAL_MAX_FLIPS; flip++) {
+        if (time_up()) break;
+        // One pass finds whether a is forbidden and, for every variable,
+        // how many clauses forbid a with that variable flipped
+        bool falsified = false;
+        for (int j = 0; j < k; j++) breaks[j] = 0;
+        #pragma omp parallel for reduction(||:falsified) reduction(+:breaks[:k])
+        for (int i = 0; i < M; i++) {
+            uint64_t d = vals[i] ^ a;
+            if (!d) falsified = true;
+            else if (!(d & (d - 1))) breaks[k - 1 - __builtin_ctzll(d)]++;
+        }
+        if (!falsified) {
+            print_model(a, k);
+            free(breaks);
+            free(vals);
+            return RESULT_SAT;
+        }
+
+        int pick = (int)rng_below(k);
+        if (rng_below(100) >= LOCAL_NOISE) {
+            for (int j = 0; j < k; j++)
+                if (breaks[j] < breaks[pick]) pick = j;
+        }
+        a ^= (uint64_t)1 << (k - 1 - pick);
+    }
+    if (!timed_out)
+        printf("%sUnknown, local search found no model in %d flips%s\n",
+               paint(ANSI_YELLOW), LOCAL_MAX_FLIPS, paint(ANSI_RESET));
+    free(breaks);
+    free(vals);
+    return RESULT_UNKNOWN;
+}
+
+// Whether every clause has at most one positive literal, i.e. at most
+// one 0 in its forbidden row
+static bool is_horn(int M, unsigned char **forbidden, int *clause_sizes) {
+    bool horn = true;
+    #pragma omp parallel for reduction(&&:horn)
+    for (int i = 0; i < M; i++) {
+        int pos = 0;
+        for (int j = 0; j < clause_sizes[i]; j++)
+            pos += !forbidden[i][j];
+        horn = horn && pos <= 1;
+    }
+    return horn;
+}
+
+// Print the first model of a Horn formula over k >= 2 variables that has
+// at least two models, standing in for enumeration under --limit 1. Every
+// clause spans all k variables with at most one positive literal, so it
+// has a negative one and all-false satisfies it: unit propagation from
+// all-false forces nothing and the least model is 0, the first model
+// enumeration would print, found without sorting anything.
+static Result horn_first_model(int k) {
+    print_model(0, k);
+    printf("Stopped after 1 assignment(s), the assignment limit was reached\n");
+    return RESULT_SAT;
+}
+
+// Verify the model printed by an external solver (MiniSat/CaDiCaL
+// "v" lines) against the clauses instead of enumerating models
+static Result check_model(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    FILE *f = fopen(opt.check, "r");
+    if (!f) {
+        printf("Cannot open %s\n", opt.check);
+        return RESULT_INVALID;
+    }
+
+    // Value of each variable: -1 unassigned, 0 false, 1 true
+    signed char *val = malloc(k + 1);
+    memset(val, -1, k + 1);
+    char *line = NULL;
+    size_t linecap = 0;
+    bool unsat_claim = false, ok = true;
+    while (ok && getline(&line, &linecap, f) != -1) {
+        if (!strncmp(line, "s UNSATISFIABLE", 15)) unsat_claim = true;
+        if (line[0] != 'v') continue;
+        for (char *tok = strtok(line + 1, " \t\r\n"); tok; tok = strtok(NULL, " \t\r\n")) {
+            int lit = atoi(tok);
+            if (!lit) continue;
+            if (abs(lit) > k) {
+                printf("Model in %s assigns variable %d but clauses have %d literals\n",
+                       opt.check, abs(lit), k);
+                ok = false;
+                break;
+            }
+            val[abs(lit)] = lit > 0;
+        }
+    }
+    free(line);
+    fclose(f);
+
+    if (ok && unsat_claim) {
+        printf("%s claims the formula is unsatisfiable, there is no model to check\n", opt.check);
+        ok = false;
+    }
+    uint64_t model = 0;
+    for (int v = 1; ok && v <= k; v++) {
+        if (val[v] < 0) {
+            printf("Model in %s does not assign variable %d\n", opt.check, v);
+            ok = false;
+        }
+        model = (model << 1) | (val[v] > 0);
+    }
+    free(val);
+    if (!ok) return RESULT_INVALID;
+
+    // A clause is violated exactly when the model is the value it forbids
+    int violated = 0;
+    for (int i = 0; i < M; i++) {
+        if (forbidden_val(forbidden[i], clause_sizes[i]) == model) {
+            printf("Model in %s violates clause (%d)\n", opt.check, input_clauses[i].idx);
+            violated++;
+        }
+    }
+    if (!violated) {
+        printf("Model in %s satisfies every clause:\n", opt.check);
+        print_model(model, k);
+    }
+    return violated ? RESULT_INVALID : RESULT_SAT;
+}
+
+static int cmp_int(const void *a, const void *b) {
+    int x = *(const int *)a, y = *(const int *)b;
+    return (x > y) - (x < y);
+}
+
+// Forbidden value of each clause, for ordering clause indices
+static const uint64_t *mus_vals;
+
+static int cmp_by_forbidden(const void *a, const void *b) {
+    int i = *(const int *)a, j = *(const int *)b;
+    if (mus_vals[i] != mus_vals[j]) return mus_vals[i] < mus_vals[j] ? -1 : 1;
+    return (i > j) - (i < j);
+}
+
+// Sort clause indices by the assignment each clause forbids and split
+// them into groups of equal values: group g is order[start[g]..start[g+1]).
+// start needs room for M + 1 entries. Returns the number of groups.
+static int group_by_forbidden(int M, unsigned char **forbidden, int *clause_sizes,
+                              int *order, int *start)
+{
+    uint64_t *vals = malloc(M * sizeof(*vals));
+    if (!vals) { perror("malloc"); exit(1); }
+
+    #pragma omp parallel for
+    for (int i = 0; i < M; i++) {
+        vals[i]  = forbidden_val(forbidden[i], clause_sizes[i]);
+        order[i] = i;
+    }
+    mus_vals = vals;
+    qsort(order, M, sizeof(*order), cmp_by_forbidden);
+    mus_vals = NULL;
+
+    int groups = 0;
+    for (int g = 0; g < M; g++)
+        if (!g || vals[order[g]] != vals[order[g - 1]]) start[groups++] = g;
+    start[groups] = M;
+    free(vals);
+    return groups;
+}
+
+// Input lines behind the groups of an unsatisfiable clause set. A
+// constraint line compiles into many clauses, so the subsets are reported
+// as the lines the user wrote: the lines of the group's clauses and of
+// every constraint its assignment violates, since a compiled clause names
+// only the first. Group g has the distinct line numbers
+// line[start[g]..start[g+1]) in increasing order and id[] gives each
+// entry's index into the n_lines distinct lines of all groups, all[].
+// Line u is in the groups of[at[u]..at[u+1]).
+typedef struct {
+    int  groups, n_lines;
+    int *start, *line, *id;
+    int *all, *at, *of;
+} LineGroups;
+
+static LineGroups group_lines(int M, unsigned char **forbidden, int *clause_sizes) {
+    LineGroups lg;
+    int *order  = malloc(M * sizeof(*order));
+    int *cstart = malloc((M + 1) * sizeof(*cstart));
+    lg.start = malloc((M + 1) * sizeof(*lg.start));
+    if (!order || !cstart || !lg.start) { perror("malloc"); exit(1); }
+    lg.groups = group_by_forbidden(M, forbidden, clause_sizes, order, cstart);
+
+    int k = input_clauses[0].sz, constraints = pb_n + table_n + formula_n;
+    int n = 0, cap = 0;
+    lg.line = NULL;
+    for (int g = 0; g < lg.groups; g++) {
+        int first = lg.start[g] = n;
+        int need  = n + cstart[g + 1] - cstart[g] + constraints;
+        if (need > cap) {
+            cap = need > 2 * cap ? need : 2 * cap;
+            lg.line = realloc(lg.line, cap * sizeof(*lg.line));
+            if (!lg.line) { perror("realloc"); exit(1); }
+        }
+        for (int j = cstart[g]; j < cstart[g + 1]; j++)
+            lg.line[n++] = input_clauses[order[j]].line;
+        if (constraints) {
+            // Every clause forbids one full assignment; rebuild it from the first
+            const Clause *c = &input_clauses[order[cstart[g]]];
+            uint64_t v = 0;
+            for (int i = 0; i < c->sz; i++)
+                if (c->orig[i] < 0) v |= (uint64_t)1 << (k - abs(c->orig[i]));
+            n += violated_lines(v, k, lg.line + n);
+        }
+        qsort(lg.line + first, n - first, sizeof(int), cmp_int);
+        int d = first;
+        for (int j = first; j < n; j++)
+            if (j == first || lg.line[j] != lg.line[d - 1]) lg.line[d++] = lg.line[j];
+        n = d;
+    }
+    lg.start[lg.groups] = n;
+
+    lg.id  = malloc((n + 1) * sizeof(*lg.id));
+    lg.all = malloc((n + 1) * sizeof(*lg.all));
+    lg.of  = malloc((n + 1) * sizeof(*lg.of));
+    if (!lg.id || !lg.all || !lg.of) { perror("malloc"); exit(1); }
+    memcpy(lg.all, lg.line, n * sizeof(int));
+    qsort(lg.all, n, sizeof(int), cmp_int);
+    lg.n_lines = 0;
+    for (int j = 0; j < n; j++)
+        if (!j || lg.all[j] != lg.all[lg.n_lines - 1]) lg.all[lg.n_lines++] = lg.all[j];
+
+    lg.at = calloc(lg.n_lines + 1, sizeof(*lg.at));
+    if (!lg.at) { perror("calloc"); exit(1); }
+    for (int j = 0; j < n; j++) {
+        lg.id[j] = (int *)bsearch(&lg.line[j], lg.all, lg.n_lines, sizeof(int), cmp_int) - lg.all;
+        lg.at[lg.id[j] + 1]++;
+    }
+    for (int u = 0; u < lg.n_lines; u++) lg.at[u + 1] += lg.at[u];
+    // Fill each line's groups, shifting at[] down by one entry, then back
+    for (int g = 0; g < lg.groups; g++)
+        for (int j = lg.start[g]; j < lg.start[g + 1]; j++) lg.of[lg.at[lg.id[j]]++] = g;
+    memmove(lg.at + 1, lg.at, lg.n_lines * sizeof(int));
+    lg.at[0] = 0;
+
+    free(order);
+    free(cstart);
+    return lg;
+}
+
+static void free_line_groups(LineGroups *lg) {
+    free(lg->start);
+    free(lg->line);
+    free(lg->id);
+    free(lg->all);
+    free(lg->at);
+    free(lg->of);
+}
+
+// Shrink an unsatisfiable clause set to a minimal unsatisfiable subset of
+// its input lines by deletion: drop each line in turn and keep it out while
+// the rest stays unsatisfiable. The rest stays unsatisfiable exactly when
+// every forbidden assignment still has a remaining line forbidding it, so
+// the oracle is a count of remaining lines per forbidden value.
+static void report_mus(int M, unsigned char **forbidden, int *clause_sizes) {
+    LineGroups lg = group_lines(M, forbidden, clause_sizes);
+    int  *left = malloc(lg.groups * sizeof(*left));   // remaining per group
+    bool *kept = malloc(lg.n_lines * sizeof(*kept));
+    if (!left || !kept) { perror("malloc"); exit(1); }
+    for (int g = 0; g < lg.groups; g++) left[g] = lg.start[g + 1] - lg.start[g];
+
+    // Try the latest lines first so the earliest of duplicates is kept
+    int size = 0;
+    for (int u = lg.n_lines - 1; u >= 0; u--) {
+        kept[u] = false;
+        for (int j = lg.at[u]; j < lg.at[u + 1]; j++)
+            if (left[lg.of[j]] == 1) kept[u] = true;
+        if (kept[u]) { size++; continue; }
+        for (int j = lg.at[u]; j < lg.at[u + 1]; j++) left[lg.of[j]]--;
+    }
+
+    printf("Minimal unsatisfiable subset (%d of %d input lines):\n", size, lg.n_lines);
+    for (int u = 0; u < lg.n_lines; u++)
+        if (kept[u]) printf("line %d%s", lg.all[u], --size ? ", " : "\n");
+
+    free(left);
+    free(kept);
+    free_line_groups(&lg);
+}
+
+// Whether the lines of group h are a subset of those of group g
+static bool line_subset(const LineGroups *lg, int h, int g) {
+    int j = lg->start[g];
+    for (int i = lg->start[h]; i < lg->start[h + 1]; i++) {
+        while (j < lg->start[g + 1] && lg->line[j] < lg->line[i]) j++;
+        if (j == lg->start[g + 1] || lg->line[j] != lg->line[i]) return false;
+    }
+    return true;
+}
+
+// Enumerate every MUS and MCS of an unsatisfiable clause set, as input
+// lines. With one forbidden assignment per clause the structure is
+// explicit: removing the lines behind one forbidden value restores a model,
+// so the smallest such line sets are the minimal correction sets, and the
+// minimal sets of lines reaching every value are the minimal unsatisfiable
+// subsets.
+static void report_all_mus_mcs(int M, unsigned char **forbidden, int *clause_sizes) {
+    LineGroups lg = group_lines(M, forbidden, clause_sizes);
+    int   groups = lg.groups;
+    bool *minimal = malloc(groups * sizeof(*minimal));
+    if (!minimal) { perror("malloc"); exit(1); }
+
+    // A group is a minimal correction set unless another group's lines are a
+    // proper subset of its own, or the same lines came first
+    int n_mcs = 0;
+    for (int g = 0; g < groups; g++) {
+        int size = lg.start[g + 1] - lg.start[g];
+        minimal[g] = true;
+        for (int j = lg.start[g]; j < lg.start[g + 1] && minimal[g]; j++) {
+            int u = lg.id[j];
+            for (int t = lg.at[u]; t < lg.at[u + 1]; t++) {
+                int h = lg.of[t];
+                if (h == g || !line_subset(&lg, h, g)) continue;
+                if (lg.start[h + 1] - lg.start[h] < size || h < g) {
+                    minimal[g] = false;
+                    break;
+                }
+            }
+        }
+        n_mcs += minimal[g];
+    }
+    printf("Minimal correction sets (%d):\n", n_mcs);
+    for (int g = 0; g < groups; g++) {
+        if (!minimal[g]) continue;
+        for (int j = lg.start[g]; j < lg.start[g + 1]; j++)
+            printf("line %d%s", lg.line[j], j + 1 < lg.start[g + 1] ? ", " : "\n");
+    }
+
+    // Mixed-radix counter choosing one line per group. A choice is printed
+    // when its lines are minimal, each being the only chosen line of some
+    // group, and every group chose the earliest of its chosen lines, so
+    // each subset is printed once.
+    int  *pick   = calloc(groups, sizeof(*pick));
+    int  *chosen = calloc(groups, sizeof(*chosen));   // chosen lines per group
+    bool *in     = calloc(lg.n_lines, sizeof(*in));
+    if (!pick || !chosen || !in) { perror("calloc"); exit(1); }
+    uint64_t printed = 0;
+    printf("Minimal unsatisfiable subsets:\n");
+    for (;;) {
+        if (opt.limit && printed == opt.limit) {
+            printf("Stopped after %" PRIu64 " subset(s), the limit was reached\n", printed);
+            break;
         }
-        free(clause);
-        free(forbidden);
-        free(clause_sizes);
+        for (int g = 0; g < groups; g++) in[lg.id[lg.start[g] + pick[g]]] = true;
+        bool print = true;
+        for (int g = 0; g < groups && print; g++) {
+            chosen[g] = 0;
+            for (int j = lg.start[g]; j < lg.start[g + 1]; j++) {
+                if (!in[lg.id[j]]) continue;
+                if (!chosen[g]++ && j != lg.start[g] + pick[g]) print = false;
+            }
+        }
+        for (int u = 0; u < lg.n_lines && print; u++) {
+            if (!in[u]) continue;
+            bool needed = false;
+            for (int t = lg.at[u]; t < lg.at[u + 1]; t++)
+                if (chosen[lg.of[t]] == 1) needed = true;
+            print = needed;
+        }
+        if (print) {
+            const char *sep = "";
+            for (int u = 0; u < lg.n_lines; u++)
+                if (in[u]) { printf("%sline %d", sep, lg.all[u]); sep = ", "; }
+            printf("\n");
+            printed++;
+        }
+        for (int g = 0; g < groups; g++) in[lg.id[lg.start[g] + pick[g]]] = false;
+
+        int g = groups - 1;
+        while (g >= 0 && ++pick[g] == lg.start[g + 1] - lg.start[g]) pick[g--] = 0;
+        if (g < 0) break;
+    }
+    free(pick);
+    free(chosen);
+    free(in);
+    free(minimal);
+    free_line_groups(&lg);
+}
+
+// Write one proof clause forbidding the assignment p of variables 1..L
+static void write_prefix_clause(FILE *f, uint64_t p, int L, bool deletion) {
+    if (deletion) fputs("d ", f);
+    for (int i = 1; i <= L; i++)
+        fprintf(f, "%d ", ((p >> (L - i)) & 1) ? -i : i);
+    fputs("0\n", f);
+}
+
+// Write a DRAT refutation for unsatisfiable input over k variables. Every
+// assignment is forbidden, so the clauses are resolved level by level:
+// the clause forbidding a prefix of length L is a RUP consequence of the
+// two clauses forbidding its extensions of length L + 1, ending with the
+// empty clause. Lemmas of the previous level are deleted once used.
+// Literal i is variable i, as in DIMACS input.
+static void write_drat_proof(int k) {
+    FILE *f = fopen(opt.proof, "w");
+    if (!f) {
+        printf("Cannot write proof to %s\n", opt.proof);
+        return;
+    }
+    for (int L = k - 1; L >= 1; L--) {
+        for (uint64_t p = 0; p < ((uint64_t)1 << L); p++)
+            write_prefix_clause(f, p, L, false);
+        if (L + 1 < k)
+            for (uint64_t p = 0; p < ((uint64_t)1 << (L + 1)); p++)
+                write_prefix_clause(f, p, L + 1, true);
+    }
+    fputs("0\n", f);
+    fclose(f);
+    printf("DRAT proof written to %s\n", opt.proof);
+}
+
+// Print the model closest in Hamming distance to the --prefer assignment.
+// Flip masks are tried in order of increasing popcount (Gosper's hack);
+// at most one more than the number of forbidden values is ever examined.
+static Result closest_assignment(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    if (k > 63) {
+        printf("Invalid input, --prefer supports at most 63 variables\n");
+        return RESULT_INVALID;
+    }
+    if ((int)strlen(opt.prefer) != k) {
+        printf("Invalid input, --prefer has %d bits but clauses have %d literals\n",
+               (int)strlen(opt.prefer), k);
+        return RESULT_INVALID;
+    }
+    uint64_t base = 0;
+    for (int i = 0; i < k; i++)
+        base = (base << 1) | (opt.prefer[i] == '1');
+
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+
+    bool found = false;
+    uint64_t all = ((uint64_t)1 << k) - 1;
+    for (int r = 0; r <= k && !found; r++) {
+        uint64_t mask = ((uint64_t)1 << r) - 1;
+        while (mask <= all) {
+            if (!is_forbidden(vals, n, base ^ mask)) {
+                printf("Closest assignment to the preferred one (distance %d):\n", r);
+                print_model(base ^ mask, k);
+                found = true;
+                break;
+            }
+            if (!mask) break;
+            uint64_t c = mask & -mask, next = mask + c;
+            mask = (((next ^ mask) >> 2) / c) | next;
+        }
+    }
+    free(vals);
+    return found ? RESULT_SAT : RESULT_UNSAT;
+}
+
+// Reduce the first model to a prime implicant: free each variable in
+// turn and keep it free while no forbidden assignment agrees with the
+// remaining literals. Freeing only gets harder as more variables are
+// free, so one pass leaves no literal that could still be dropped.
+static Result prime_implicant(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+
+    // The first model is the first value missing from the sorted list
+    uint64_t model = 0;
+    int i = 0;
+    while (i < n && vals[i] == model) {
+        if (model == (k == 64 ? UINT64_MAX : ((uint64_t)1 << k) - 1)) {
+            free(vals);
+            return RESULT_UNSAT;
+        }
+        model++;
+        i++;
+    }
+    if (opt.verify) verify_model(model, k);
+
+    uint64_t mask = k == 64 ? UINT64_MAX : ((uint64_t)1 << k) - 1;
+    for (int v = 1; v <= k; v++) {
+        uint64_t trial = mask & ~((uint64_t)1 << (k - v));
+        bool blocked = false;
+        for (int j = 0; j < n && !blocked; j++)
+            blocked = (vals[j] & trial) == (model & trial);
+        if (!blocked) mask = trial;
+    }
+
+    if (opt.json) {
+        json_implicant      = true;
+        json_implicant_mask = mask;
+        json_implicant_val  = model;
+    }
+    printf("Prime implicant of the first model (- marks a free variable):\n");
+    for (int v = 1; v <= k; v++) {
+        uint64_t bit = (uint64_t)1 << (k - v);
+        putchar(!(mask & bit) ? '-' : (model & bit) ? '1' : '0');
+        if (v < k) putchar(' ');
+    }
+    putchar('\n');
+    free(vals);
+    return RESULT_SAT;
+}
+
+// List the prime implicates with at most --implicates literals. A clause
+// over the variables in mask is implied when all 2^(k-s) assignments that
+// falsify it are forbidden; sizes are visited in increasing order, so a
+// clause is prime unless an implicate found earlier subsumes it.
+static Result list_prime_implicates(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0], N = opt.implicates < k ? opt.implicates : k;
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        return RESULT_UNKNOWN;
+    }
+    uint64_t *keys = malloc((n ? n : 1) * sizeof(*keys));
+
+    // Found implicates as the mask of their variables and the value of
+    // those variables in the assignments they exclude
+    uint64_t *found_mask = NULL, *found_val = NULL;
+    int found = 0, found_cap = 0;
+    uint64_t all = k == 64 ? UINT64_MAX : ((uint64_t)1 << k) - 1;
+    bool stopped = false;
+
+    printf("Prime implicates with at most %d literal(s):\n", N);
+    for (int sz = 0; sz <= N && !stopped; sz++) {
+        uint64_t need = k - sz < 63 ? (uint64_t)1 << (k - sz) : UINT64_MAX;
+        uint64_t mask = sz == 64 ? UINT64_MAX : ((uint64_t)1 << sz) - 1;
+        while (!stopped && mask <= all) {
+            if (time_up()) {
+                printf("Stopped after %d implicate(s), the time limit was reached\n", found);
+                stopped = true;
+                break;
+            }
+            for (int i = 0; i < n; i++) keys[i] = vals[i] & mask;
+            qsort(keys, n, sizeof(*keys), cmp_u64);
+            for (int i = 0; i < n && !stopped; ) {
+                int j = i;
+                while (j < n && keys[j] == keys[i]) j++;
+                uint64_t key = keys[i];
+                bool implied = (uint64_t)(j - i) == need, subsumed = false;
+                i = j;
+                for (int f = 0; implied && f < found && !subsumed; f++)
+                    subsumed = (found_mask[f] & mask) == found_mask[f] &&
+                               (key & found_mask[f]) == found_val[f];
+                if (!implied || subsumed) continue;
+
+                if (opt.limit && (uint64_t)found == opt.limit) {
+                    printf("Stopped after %d implicate(s), the limit was reached\n", found);
+                    stopped = true;
+                    break;
+                }
+                if (found == found_cap) {
+                    found_cap = found_cap ? found_cap * 2 : 16;
+                    found_mask = realloc(found_mask, found_cap * sizeof(*found_mask));
+                    found_val  = realloc(found_val,  found_cap * sizeof(*found_val));
+                }
+                found_mask[found] = mask;
+                found_val[found]  = key;
+                found++;
+                for (int v = 1; v <= k; v++) {
+                    uint64_t bit = (uint64_t)1 << (k - v);
+                    if (mask & bit) printf("%d ", (key & bit) ? -v : v);
+                }
+                printf("0\n");
+            }
+            if (!mask) break;
+            uint64_t c = mask & -mask, next = mask + c;
+            if (next < mask) break;
+            mask = (((next ^ mask) >> 2) / c) | next;
+        }
+    }
+    if (!found) printf("None\n");
+    free(found_mask);
+    free(found_val);
+    free(keys);
+    free(vals);
+    // Every assignment is forbidden exactly when the input is unsatisfiable
+    return k < 64 && (uint64_t)n == (uint64_t)1 << k ? RESULT_UNSAT : RESULT_SAT;
+}
+
+// Formulas over at most this many variables are minimized with
+// Quine-McCluskey, larger ones by expanding each forbidden assignment
+#define QM_MAX_VARS 12
+
+// Clause as a cube of forbidden assignments: mask has the bits of its
+// variables and val their values in the assignments it excludes
+typedef struct {
+    uint64_t mask, val;
+} Cube;
+
+static int cmp_cube(const void *a, const void *b) {
+    const Cube *x = a, *y = b;
+    if (x->mask != y->mask) return (x->mask > y->mask) - (x->mask < y->mask);
+    return (x->val > y->val) - (x->val < y->val);
+}
+
+// Prime cubes of the forbidden values by Quine-McCluskey: cubes that differ
+// in one variable merge into a cube without it, and cubes that never merge
+// are prime. *n_primes receives the count.
+static Cube *qm_primes(const uint64_t *vals, int n, int k, int *n_primes) {
+    uint64_t all = ((uint64_t)1 << k) - 1;
+    Cube *level = malloc((n ? n : 1) * sizeof(Cube)), *primes = NULL;
+    int n_level = n, np = 0, cap = 0;
+    for (int i = 0; i < n; i++) level[i] = (Cube){ all, vals[i] };
+
+    while (n_level && !time_up()) {
+        qsort(level, n_level, sizeof(Cube), cmp_cube);
+        int d = 0;
+        for (int i = 0; i < n_level; i++)
+            if (!d || cmp_cube(&level[i], &level[d - 1])) level[d++] = level[i];
+        n_level = d;
+
+        bool *merged = calloc(n_level, sizeof(bool));
+        Cube *next = NULL;
+        int n_next = 0, next_cap = 0;
+        for (int i = 0; i < n_level; i++) {
+            for (uint64_t rest = level[i].mask; rest; rest &= rest - 1) {
+                uint64_t b = rest & -rest;
+                if (level[i].val & b) continue;
+                Cube partner = { level[i].mask, level[i].val | b };
+                Cube *p = bsearch(&partner, level, n_level, sizeof(Cube), cmp_cube);
+                if (!p) continue;
+                merged[i] = merged[p - level] = true;
+                if (n_next == next_cap) {
+                    next_cap = next_cap ? next_cap * 2 : 16;
+                    next = realloc(next, next_cap * sizeof(Cube));
+                }
+                next[n_next++] = (Cube){ level[i].mask & ~b, level[i].val };
+            }
+        }
+        for (int i = 0; i < n_level; i++) {
+            if (merged[i]) continue;
+            if (np == cap) {
+                cap = cap ? cap * 2 : 16;
+                primes = realloc(primes, cap * sizeof(Cube));
+            }
+            primes[np++] = level[i];
+        }
+        free(merged);
+        free(level);
+        level   = next;
+        n_level = n_next;
+    }
+    free(level);
+    *n_primes = np;
+    return primes;
+}
+
+// Number of forbidden values inside a cube
+static uint64_t cube_count(const uint64_t *vals, int n, Cube c) {
+    uint64_t count = 0;
+    for (int i = 0; i < n; i++)
+        count += (vals[i] & c.mask) == c.val;
+    return count;
+}
+
+// Print a small set of clauses equivalent to the input. Up to QM_MAX_VARS
+// variables the prime implicates come from Quine-McCluskey and are chosen
+// greedily by how many uncovered forbidden assignments they exclude. Above
+// that, in the manner of Espresso's expand step, each uncovered forbidden
+// assignment is widened one variable at a time while the cube stays
+// entirely forbidden. Either way the result is a cover by prime implicates,
+// near-minimal but not guaranteed minimum.
+static Result minimize_clauses(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0], n;
+    if (k > 63) {
+        printf("Invalid input, minimization supports at most 63 variables\n");
+        return RESULT_INVALID;
+    }
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    bool *covered = calloc(n, sizeof(bool));
+    Cube *cover = NULL;
+    int n_cover = 0, left = n;
+
+    progress_phase = "minimizing clauses";
+    if (k <= QM_MAX_VARS) {
+        int np;
+        Cube *primes = qm_primes(vals, n, k, &np);
+        cover = malloc((np ? np : 1) * sizeof(Cube));
+        // Gains only shrink as assignments get covered, so stored gains are
+        // upper bounds and only the current best needs recounting (lazy greedy)
+        uint64_t *gain = malloc((np ? np : 1) * sizeof(uint64_t));
+        for (int p = 0; p < np; p++)
+            gain[p] = (uint64_t)1 << (k - __builtin_popcountll(primes[p].mask));
+        while (left && !time_up()) {
+            int best = -1;
+            for (int p = 0; p < np; p++)
+                if (gain[p] && (best < 0 || gain[p] > gain[best])) best = p;
+            if (best < 0) break;
+            uint64_t now = 0;
+            for (int i = 0; i < n; i++)
+                now += !covered[i] && (vals[i] & primes[best].mask) == primes[best].val;
+            if (now < gain[best]) {
+                gain[best] = now;
+                continue;
+            }
+            gain[best] = 0;
+            cover[n_cover++] = primes[best];
+            for (int i = 0; i < n; i++)
+                if ((vals[i] & primes[best].mask) == primes[best].val && !covered[i]) {
+                    covered[i] = true;
+                    left--;
+                }
+        }
+        free(gain);
+        free(primes);
+    } else {
+        cover = malloc((n ? n : 1) * sizeof(Cube));
+        for (int i = 0; i < n && !time_up(); i++) {
+            if (covered[i]) continue;
+            Cube c = { ((uint64_t)1 << k) - 1, vals[i] };
+            for (int v = 1; v <= k; v++) {
+                uint64_t b = (uint64_t)1 << (k - v);
+                Cube wider = { c.mask & ~b, c.val & ~b };
+                int free_vars = k - __builtin_popcountll(wider.mask);
+                if (cube_count(vals, n, wider) == (uint64_t)1 << free_vars) c = wider;
+            }
+            cover[n_cover++] = c;
+            for (int j = i; j < n; j++)
+                if ((vals[j] & c.mask) == c.val) covered[j] = true;
+        }
+    }
+
+    Result r = RESULT_SAT;
+    if (timed_out) {
+        r = RESULT_UNKNOWN;
+    } else {
+        printf("Minimized formula with %d clause(s):\n", n_cover);
+        for (int c = 0; c < n_cover; c++) {
+            for (int v = 1; v <= k; v++) {
+                uint64_t bit = (uint64_t)1 << (k - v);
+                if (cover[c].mask & bit) printf("%d ", (cover[c].val & bit) ? -v : v);
+            }
+            printf("0\n");
+        }
+        if (!n_cover) printf("None\n");
+        if ((uint64_t)n == (uint64_t)1 << k) r = RESULT_UNSAT;
+    }
+    free(cover);
+    free(covered);
+    free(vals);
+    return r;
+}
+
+// Subset of cost flips in the best-first search of min_cost_assignment
+typedef struct {
+    long long sum;    // added cost of the flips
+    uint64_t  set;    // flipped positions in ascending delta order
+    int       last;   // highest position in set
+} FlipNode;
+
+static void heap_push(FlipNode **heap, int *n, int *cap, FlipNode x) {
+    if (*n == *cap) {
+        *cap = *cap ? *cap * 2 : 64;
+        *heap = realloc(*heap, *cap * sizeof(**heap));
+    }
+    int i = (*n)++;
+    while (i && (*heap)[(i - 1) / 2].sum > x.sum) {
+        (*heap)[i] = (*heap)[(i - 1) / 2];
+        i = (i - 1) / 2;
+    }
+    (*heap)[i] = x;
+}
+
+static FlipNode heap_pop(FlipNode *heap, int *n) {
+    FlipNode top = heap[0], x = heap[--(*n)];
+    int i = 0;
+    for (;;) {
+        int c = 2 * i + 1;
+        if (c >= *n) break;
+        if (c + 1 < *n && heap[c + 1].sum < heap[c].sum) c++;
+        if (heap[c].sum >= x.sum) break;
+        heap[i] = heap[c];
+        i = c;
+    }
+    heap[i] = x;
+    return top;
+}
+
+// Deltas being ordered by cmp_delta_idx
+static const long long *delta_of;
+
+static int cmp_delta_idx(const void *a, const void *b) {
+    int i = *(const int *)a, j = *(const int *)b;
+    if (delta_of[i] != delta_of[j]) return delta_of[i] < delta_of[j] ? -1 : 1;
+    return (i > j) - (i < j);
+}
+
+// Print a model of minimum total --cost. Each variable starts at its
+// cheaper value; flipping it adds a non-negative delta. Flip subsets are
+// visited in order of increasing added cost with a heap (extend a subset
+// by the next delta, or replace its last delta by the next one), and the
+// first subset giving a non-forbidden assignment is optimal. At most one
+// more than the number of forbidden values is ever examined.
+static Result min_cost_assignment(int M, unsigned char **forbidden, int *clause_sizes) {
+    int k = clause_sizes[0];
+    if (k > 63) {
+        printf("Invalid input, --cost supports at most 63 variables\n");
+        return RESULT_INVALID;
+    }
+    for (int i = 0; i < opt.n_cost; i++) {
+        if (abs(opt.cost_lit[i]) > k) {
+            printf("Invalid input, --cost uses variable %d but clauses have %d literals\n",
+                   abs(opt.cost_lit[i]), k);
+            return RESULT_INVALID;
+        }
+    }
+
+    // Cost of each variable being false and true
+    long long *cost_f = calloc(k + 1, sizeof(long long));
+    long long *cost_t = calloc(k + 1, sizeof(long long));
+    for (int i = 0; i < opt.n_cost; i++) {
+        int v = abs(opt.cost_lit[i]);
+        if (opt.cost_lit[i] > 0) cost_t[v] += opt.cost[i];
+        else                     cost_f[v] += opt.cost[i];
+    }
+    uint64_t  base = 0;
+    long long base_cost = 0;
+    long long *delta = malloc(k * sizeof(*delta));
+    int       *order = malloc(k * sizeof(*order));
+    for (int v = 1; v <= k; v++) {
+        bool t = cost_t[v] < cost_f[v];
+        base = (base << 1) | t;
+        base_cost += t ? cost_t[v] : cost_f[v];
+        delta[v - 1] = t ? cost_f[v] - cost_t[v] : cost_t[v] - cost_f[v];
+        order[v - 1] = v - 1;
+    }
+    delta_of = delta;
+    qsort(order, k, sizeof(*order), cmp_delta_idx);
+    delta_of = NULL;
+
+    int n;
+    uint64_t *vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+    if (time_up()) {
+        free(vals);
+        free(delta);
+        free(order);
+        free(cost_f);
+        free(cost_t);
+        return RESULT_UNKNOWN;
+    }
+
+    FlipNode *heap = NULL;
+    int heap_n = 0, heap_cap = 0;
+    bool found = false;
+    uint64_t model = base;
+    long long total = base_cost;
+    if (!is_forbidden(vals, n, base)) {
+        found = true;
+    } else if (k > 0) {
+        heap_push(&heap, &heap_n, &heap_cap, (FlipNode){ delta[order[0]], 1, 0 });
+    }
+    while (!found && heap_n) {
+        FlipNode x = heap_pop(heap, &heap_n);
+        uint64_t flips = 0;
+        for (int p = 0; p <= x.last; p++)
+            if (x.set >> p & 1) flips |= (uint64_t)1 << (k - 1 - order[p]);
+        if (!is_forbidden(vals, n, base ^ flips)) {
+            found = true;
+            model = base ^ flips;
+            total = base_cost + x.sum;
+            break;
+        }
+        if (x.last + 1 < k) {
+            long long next = delta[order[x.last + 1]];
+            uint64_t  bit  = (uint64_t)1 << (x.last + 1);
+            heap_push(&heap, &heap_n, &heap_cap,
+                      (FlipNode){ x.sum + next, x.set | bit, x.last + 1 });
+            heap_push(&heap, &heap_n, &heap_cap,
+                      (FlipNode){ x.sum - delta[order[x.last]] + next,
+                                  (x.set & ~((uint64_t)1 << x.last)) | bit, x.last + 1 });
+        }
+    }
+
+    if (found) {
+        printf("Minimum-cost assignment (cost %lld):\n", total);
+        print_model(model, k);
+        printf("Cost breakdown:\n");
+        for (int v = 1; v <= k; v++) {
+            bool t = (model >> (k - v)) & 1;
+            long long c = t ? cost_t[v] : cost_f[v];
+            if (c) printf("  variable %d = %d costs %lld\n", v, t, c);
+        }
+    }
+    free(heap);
+    free(vals);
+    free(delta);
+    free(order);
+    free(cost_f);
+    free(cost_t);
+    return found ? RESULT_SAT : RESULT_UNSAT;
+}
+
+// Peak resident set size in KiB, or -1 where it is not available
+static long peak_memory_kib(void) {
+#ifndef _WIN32
+    struct rusage ru;
+    if (getrusage(RUSAGE_SELF, &ru)) return -1;
+#ifdef __APPLE__
+    return ru.ru_maxrss / 1024;
+#else
+    return ru.ru_maxrss;
+#endif
+#else
+    return -1;
+#endif
+}
+
+// Print --stats for a solve that took the given wall time and ended with r
+static void print_stats(int M, int n_input, unsigned char **forbidden,
+                        int *clause_sizes, const char *path, Result r, double seconds)
+{
+    // Sorted with qsort, which --timeout does not cut short, so the
+    // count is exact even when the solve itself was stopped
+    int k = clause_sizes[0], n = 0;
+    uint64_t *vals = malloc((size_t)M * sizeof *vals);
+    if (!vals) { perror("malloc"); exit(1); }
+    #pragma omp parallel for
+    for (int i = 0; i < M; i++)
+        vals[i] = forbidden_val(forbidden[i], clause_sizes[i]);
+    qsort(vals, M, sizeof(*vals), cmp_u64);
+    for (int i = 0; i < M; i++)
+        if (!n || vals[i] != vals[n - 1]) vals[n++] = vals[i];
+    free(vals);
+
+    fputs(paint(ANSI_DIM), stdout);
+    printf("Statistics:\n");
+    printf("  variables            %d\n", k);
+    printf("  input clauses        %d\n", n_input);
+    printf("  compiled clauses     %d\n", M - n_input);
+    printf("  distinct forbidden   %d\n", n);
+    printf("  horn formula         %s\n", is_horn(M, forbidden, clause_sizes) ? "yes" : "no");
+    printf("  solve path           %s\n", path);
+    // An unknown result has no model count to stand behind
+    if (k < 64 && r != RESULT_UNKNOWN)
+        printf("  models               %" PRIu64 "\n", ((uint64_t)1 << k) - n);
+    printf("  threads              %d\n", omp_get_max_threads());
+    printf("  solve time           %.3f s\n", seconds);
+    long kib = peak_memory_kib();
+    if (kib >= 0) printf("  peak memory          %ld KiB\n", kib);
+    fputs(paint(ANSI_RESET), stdout);
+}
+
+// Largest selftest formula, and most nodes in one of its formula lines
+#define SELFTEST_MAX_VARS  10
+#define SELFTEST_MAX_NODES 16
+
+// One line of a selftest input as generated, kept so the truth table can
+// be computed from what the text means rather than from what was parsed.
+// Clauses and cardinality constraints use lit; formulas use node, with
+// the root last.
+typedef struct {
+    char        kind;     // 'c' clause, 'm' atmost, 'l' atleast, 'f' formula
+    int         lit[SELFTEST_MAX_VARS + 1];
+    int         n, bound;
+    FormulaNode node[SELFTEST_MAX_NODES];
+    int         n_node;
+} SelftestLine;
+
+static bool selftest_bit(uint64_t a, int k, int lit) {
+    return (((a >> (k - abs(lit))) & 1) != 0) == (lit > 0);
+}
+
+// Write a random formula of at most the given depth over variables 1..k
+// and add its nodes to the line; returns the index of its root
+static int selftest_formula(SelftestLine *l, int depth, int k, FILE *f) {
+    static const char *const symbol[] = { "&", "|", "^", "xor", "->", "<->" };
+    static const char op[] = { '&', '|', '^', '^', '>', '=' };
+    FormulaNode nd = { 'v', 0, 0 };
+    int r = (int)rng_below(depth ? 10 : 5);
+    if (r == 0) {
+        nd = (FormulaNode){ 'c', (int)rng_below(2), 0 };
+        fputs(nd.a ? "true" : "false", f);
+    } else if (r < 5) {
+        nd.a = 1 + (int)rng_below(k);
+        fprintf(f, "%d", nd.a);
+    } else if (r < 7) {
+        fputc(rng_below(2) ? '!' : '-', f);
+        nd = (FormulaNode){ '!', selftest_formula(l, depth - 1, k, f), 0 };
+    } else {
+        int s = (int)rng_below(6);
+        fputc('(', f);
+        nd.a = selftest_formula(l, depth - 1, k, f);
+        fprintf(f, " %s ", symbol[s]);
+        nd.b = selftest_formula(l, depth - 1, k, f);
+        fputc(')', f);
+        nd.op = op[s];
+    }
+    l->node[l->n_node] = nd;
+    return l->n_node++;
+}
+
+static bool selftest_eval(const FormulaNode *node, int i, uint64_t a, int k) {
+    const FormulaNode *nd = &node[i];
+    bool x = nd->op == 'v' ? selftest_bit(a, k, nd->a)
+           : nd->op == 'c' ? nd->a
+           : selftest_eval(node, nd->a, a, k);
+    bool y = strchr("&|^>=", nd->op) && selftest_eval(node, nd->b, a, k);
+    switch (nd->op) {
+    case '!': return !x;
+    case '&': return x && y;
+    case '|': return x || y;
+    case '^': return x != y;
+    case '>': return !x || y;
+    case '=': return x == y;
+    default:  return x;
+    }
+}
+
+// Whether assignment a of k variables satisfies a generated line
+static bool selftest_holds(const SelftestLine *l, uint64_t a, int k) {
+    if (l->kind == 'f') return selftest_eval(l->node, l->n_node - 1, a, k);
+    int count = 0;
+    for (int i = 0; i < l->n; i++)
+        count += selftest_bit(a, k, l->lit[i]);
+    if (l->kind == 'm') return count <= l->bound;
+    if (l->kind == 'l') return count >= l->bound;
+    return count > 0;
+}
+
+// Write a random input over k variables as text and record its lines.
+// The first line is always a plain clause, so the width is k; the rest
+// mix clauses in any literal order, clauses with a repeated literal,
+// tautologies, cardinality constraints and formulas, some indented.
+static void selftest_input(SelftestLine *line, int n, int k, FILE *f) {
+    for (int i = 0; i < n; i++) {
+        SelftestLine *l = &line[i];
+        int r = i ? (int)rng_below(16) : 15;
+        l->n = l->n_node = 0;
+        if (!rng_below(4)) fputs("  ", f);
+        if (r == 0) {
+            l->kind = 'f';
+            fputs("formula ", f);
+            selftest_formula(l, 3, k, f);
+        } else if (r == 1) {
+            l->kind = rng_below(2) ? 'm' : 'l';
+            for (int v = 1; v <= k; v++)
+                if (!l->n || rng_below(2))
+                    l->lit[l->n++] = rng_below(2) ? -v : v;
+            l->bound = (int)rng_below(l->n + 1);
+            fprintf(f, "%s(%d", l->kind == 'm' ? "atmost" : "atleast", l->bound);
+            for (int j = 0; j < l->n; j++) fprintf(f, ", %d", l->lit[j]);
+            fputc(')', f);
+        } else {
+            l->kind = 'c';
+            for (int v = 1; v <= k; v++)
+                l->lit[l->n++] = rng_below(2) ? -v : v;
+            // A repeated literal, or the negation of one for a tautology
+            if (r == 2 || r == 3) {
+                int lit = l->lit[rng_below(l->n)];
+                l->lit[l->n++] = r == 2 ? lit : -lit;
+            }
+            for (int j = l->n - 1; j > 0; j--) {
+                int t = (int)rng_below(j + 1), tmp = l->lit[j];
+                l->lit[j] = l->lit[t];
+                l->lit[t] = tmp;
+            }
+            for (int j = 0; j < l->n; j++) fprintf(f, "%d ", l->lit[j]);
+            fputc('0', f);
+        }
+        fputc('\n', f);
+    }
+    fputc('\n', f);
+}
+
+static void selftest_copy(FILE *from) {
+    rewind(from);
+    for (int ch; (ch = fgetc(from)) != EOF; ) putchar(ch);
+}
+
+// Solve random small inputs written as text, through the same reading,
+// simplification and constraint compilation as real input, and compare
+// every assignment with a brute-force truth table of what the text
+// means. Returns the exit status.
+static int run_selftest(int count) {
+    if (opt.seeded) rng_state = opt.seed * 0x9E3779B97F4A7C15ULL | 1;
+    SelftestLine *line = malloc(((size_t)3 << SELFTEST_MAX_VARS) / 2 * sizeof(*line));
+    progress_started = omp_get_wtime();
+    progress_next    = progress_started + PROGRESS_INTERVAL;
+    models_printed   = 0;
+    FILE *saved_input = input_file;
+    interactive = false;
+    for (int t = 0; t < count; t++) {
+        // Sorting names its own phases; each input starts over
+        progress_phase = "cross-checking random inputs";
+        int k = 1 + (int)rng_below(SELFTEST_MAX_VARS);
+        int n_lines = 1 + (int)rng_below(((uint64_t)3 << k) / 2);
+
+        FILE *text = tmpfile(), *out = tmpfile();
+        if (!text || !out) {
+            fprintf(stderr, "Cannot create temporary files for --selftest\n");
+            return 1;
+        }
+        selftest_input(line, n_lines, k, text);
+        rewind(text);
+
+        // Everything the solver prints goes to out, shown on failure
+        fflush(stdout);
+        int saved_fd = dup(fileno(stdout));
+        dup2(fileno(out), fileno(stdout));
+        input_file   = text;
+        early_result = RESULT_INVALID;
+        int M;
+        Clause *clause = read_clause(&M);
+        bool solved = simplify_clauses(clause, &M) &&
+                      compile_constraints(&clause, &M) &&
+                      I_process_clause(clause, M);
+        fflush(stdout);
+        dup2(saved_fd, fileno(stdout));
+        close(saved_fd);
+
+        // Without rows the early result stands for every assignment
+        uint64_t *vals = NULL;
+        int n = 0;
+        if (solved) {
+            unsigned char  *rows         = malloc((size_t)M * k);
+            unsigned char **forbidden    = malloc(M * sizeof(*forbidden));
+            int            *clause_sizes = malloc(M * sizeof(*clause_sizes));
+            for (int i = 0; i < M; i++) {
+                clause_sizes[i] = clause[i].sz;
+                forbidden[i]    = rows + (size_t)i * k;
+                II_process_clause(&clause[i], k, forbidden[i]);
+            }
+            vals = distinct_forbidden_vals(M, forbidden, clause_sizes, &n);
+            for (int i = 0; i < M; i++) free(clause[i].orig);
+            free(clause);
+            free(rows);
+            free(forbidden);
+            free(clause_sizes);
+        }
+        free_constraints();
+        free_qbf_prefix();
+
+        uint64_t models = 0, total = (uint64_t)1 << k, bad = total;
+        for (uint64_t a = 0; a < total && bad == total; a++) {
+            bool sat = true;
+            for (int i = 0; i < n_lines && sat; i++)
+                sat = selftest_holds(&line[i], a, k);
+            models += sat;
+            bool model = solved ? !is_forbidden(vals, n, a) : early_result == RESULT_SAT;
+            if (sat != model) bad = a;
+        }
+        uint64_t solver_models = solved ? total - n : early_result == RESULT_SAT ? total : 0;
+
+        if (bad != total || models != solver_models ||
+            (!solved && early_result == RESULT_INVALID)) {
+            printf("Selftest failed on input %d of %d:\n", t + 1, count);
+            selftest_copy(text);
+            printf("Solver output:\n");
+            selftest_copy(out);
+            if (!solved && early_result == RESULT_INVALID) {
+                printf("The solver rejected the input\n");
+            } else if (bad != total) {
+                printf("Solver and truth table disagree on ");
+                print_assignment(bad, k);
+            } else {
+                printf("Model count %" PRIu64 " disagrees with %" PRIu64 " from the solver\n",
+                       models, solver_models);
+            }
+            return 1;
+        }
+        free(vals);
+        fclose(text);
+        fclose(out);
+    }
+    input_file = saved_input;
+    free(line);
+    printf("Selftest passed, %d random input(s) agree with brute force\n", count);
+    return 0;
+}
+
+// Parse a comma separated list of distinct variables like "1,3,4"
+static bool parse_var_list(const char *arg, int **vars, int *n) {
+    const char *p = arg;
+    char *end;
+    *n = 0;
+    for (;;) {
+        long v = strtol(p, &end, 10);
+        bool repeated = false;
+        for (int j = 0; j < *n; j++)
+            repeated |= (*vars)[j] == v;
+        if (end == p || v <= 0 || v > 63 || repeated) return false;
+        *vars = realloc(*vars, (*n + 1) * sizeof(int));
+        (*vars)[(*n)++] = (int)v;
+        if (!*end) return true;
+        if (*end != ',') return false;
+        p = end + 1;
+    }
+}
+
+// Under --output json the text a solve prints is captured in a temporary
+// file and returned as the "output" field of its JSON object
+static FILE  *json_capture;
+static int    json_saved_fd = -1;
+static double json_started;
+
+static void json_begin(void) {
+    fflush(stdout);
+    json_capture  = tmpfile();
+    json_saved_fd = json_capture ? dup(fileno(stdout)) : -1;
+    if (json_saved_fd < 0 || dup2(fileno(json_capture), fileno(stdout)) < 0) {
+        fprintf(stderr, "Cannot capture output for --output json\n");
+        exit(1);
+    }
+    json_n         = 0;
+    json_vars      = 0;
+    json_implicant = false;
+    json_started = omp_get_wtime();
+}
+
+static void json_string(FILE *f) {
+    putchar('"');
+    for (int ch; (ch = fgetc(f)) != EOF; ) {
+        if (ch == '"' || ch == '\\') printf("\\%c", ch);
+        else if (ch == '\n') printf("\\n");
+        else if (ch == '\t') printf("\\t");
+        else if (ch < 0x20) printf("\\u%04x", ch);
+        else putchar(ch);
+    }
+    putchar('"');
+}
+
+// Restore stdout and print the JSON object of the solve with the given status
+static void json_end(const char *status) {
+    if (json_saved_fd < 0) return;
+    fflush(stdout);
+    dup2(json_saved_fd, fileno(stdout));
+    close(json_saved_fd);
+    json_saved_fd = -1;
+
+    printf("{\"status\":\"%s\",\"variables\":%d,", status, json_vars);
+    // Projected models list the --project variables, in that order
+    if (opt.n_project) {
+        printf("\"projected\":[");
+        for (int j = 0; j < opt.n_project; j++)
+            printf(j ? ",%d" : "%d", opt.project[j]);
+        printf("],");
+    }
+    printf("\"models\":[");
+    for (size_t m = 0; m < json_n; m++) {
+        printf(m ? ",[" : "[");
+        for (int b = json_vars - 1; b >= 0; b--)
+            printf(b ? "%d," : "%d", (int)((json_models[m] >> b) & 1));
+        putchar(']');
+    }
+    putchar(']');
+    // Free variables of a prime implicant are null
+    if (json_implicant) {
+        printf(",\"implicant\":[");
+        for (int b = json_vars - 1; b >= 0; b--)
+            printf(!((json_implicant_mask >> b) & 1) ? "null%s" :
+                   (json_implicant_val >> b) & 1 ? "1%s" : "0%s", b ? "," : "");
+        putchar(']');
+    }
+    printf(",\"time\":%.6f,\"output\":", omp_get_wtime() - json_started);
+    rewind(json_capture);
+    json_string(json_capture);
+    printf("}\n");
+    fclose(json_capture);
+    json_capture = NULL;
+}
+
+// A --verify failure exits in the middle of a solve; report it as an error
+static void json_at_exit(void) {
+    json_end("ERROR");
+}
+
+// What a solve does with the forbidden rows, chosen by the options
+typedef enum {
+    MODE_NONE,        // nothing, the rows are incomplete
+    MODE_QBF,
+    MODE_CHECK,
+    MODE_COST,
+    MODE_IMPLICATES,
+    MODE_MINIMIZE,
+    MODE_PRIME,
+    MODE_PREFER,
+    MODE_SAMPLE,
+    MODE_FORGET,
+    MODE_PROJECT,
+    MODE_LOCAL,
+    MODE_HORN,
+    MODE_ENUMERATE
+} SolveMode;
+
+// Pick the mode of a solve; when several options are given, the first
+// one tested here wins
+static SolveMode solve_mode(int M, unsigned char **forbidden, int *clause_sizes) {
+    if (qbf_n)               return MODE_QBF;
+    if (opt.check)           return MODE_CHECK;
+    if (opt.n_cost)          return MODE_COST;
+    if (opt.implicates >= 0) return MODE_IMPLICATES;
+    if (opt.minimize)        return MODE_MINIMIZE;
+    if (opt.prime)           return MODE_PRIME;
+    if (opt.prefer)          return MODE_PREFER;
+    if (opt.sample)          return MODE_SAMPLE;
+    if (opt.n_forget)        return MODE_FORGET;
+    if (opt.n_project)       return MODE_PROJECT;
+    if (opt.local)           return MODE_LOCAL;
+    // Fewer than 2^k - 1 clauses leave at least two models, so a
+    // Horn formula's least model is the whole answer under --limit 1
+    int k = clause_sizes[0];
+    if (opt.limit == 1 && k >= 2 && (k >= 63 || (uint64_t)M + 2 <= (uint64_t)1 << k) &&
+        is_horn(M, forbidden, clause_sizes))
+        return MODE_HORN;
+    return MODE_ENUMERATE;
+}
+
+// Solve path of a mode as reported by --stats
+static const char *mode_path(SolveMode mode) {
+    switch (mode) {
+    case MODE_QBF:   return "qbf";
+    case MODE_LOCAL: return "local";
+    case MODE_HORN:  return "horn";
+    default:         return "complete";
+    }
+}
+
+static void report_time_limit(void) {
+    printf("%sUnknown, the time limit of %g second(s) was reached%s\n",
+           paint(ANSI_YELLOW), opt.timeout, paint(ANSI_RESET));
+}
+
+// Give up on a solve whose --timeout deadline passed before its clauses
+// were ready; the clauses are freed
+static Result stopped_preparing(Clause *clause, int M) {
+    printf("Result:\n");
+    report_time_limit();
+    for (int i = 0; i < M; i++)
+        free(clause[i].orig);
+    free(clause);
+    free_constraints();
+    free_qbf_prefix();
+    return RESULT_UNKNOWN;
+}
+
+// Solve one input and print its result; the clauses are freed
+static Result solve_input(Clause *clause, int M) {
+    double started = omp_get_wtime();
+    progress_started = started;
+    progress_next    = started + PROGRESS_INTERVAL;
+    progress_phase   = "simplifying clauses";
+    models_printed   = 0;
+    early_result = RESULT_INVALID;
+    timed_out = false;
+    deadline  = opt.timeout ? started + opt.timeout : 0;
+    // Every solve restarts from the seed so a block reproduces on its own
+    if (opt.seeded) rng_state = opt.seed * 0x9E3779B97F4A7C15ULL | 1;
+
+    if (!simplify_clauses(clause, &M)) {
+        free_constraints();
+        free_qbf_prefix();
+        return early_result;
+    }
+    // Clauses left as read by a stopped simplification are not valid input
+    if (timed_out) return stopped_preparing(clause, M);
+    int n_input = M;
+    progress_phase = "compiling constraints";
+    if (!compile_constraints(&clause, &M))
+        return early_result;
+    if (timed_out) return stopped_preparing(clause, M);
+    if (!I_process_clause(clause, M)) {
+        free_constraints();
+        free_qbf_prefix();
+        return early_result;
+    }
+
+    progress_phase = "checking for redundant clauses";
+    if (n_input > 0)
+        report_redundant_clauses(clause, n_input);
+    json_vars       = clause[0].sz;
+    input_clauses   = clause;
+    n_input_clauses = n_input;
+
+    // All clauses have the same width, so the forbidden rows share one
+    // contiguous block instead of one allocation per clause
+    size_t          width        = clause[0].sz;
+    unsigned char  *rows         = malloc((size_t)M * width);
+    unsigned char **forbidden    = malloc(M * sizeof(*forbidden));
+    int            *clause_sizes = malloc(M * sizeof(*clause_sizes));
+    Result          r = RESULT_INVALID;
+
+    printf("Result:\n");
+    progress_phase = "building forbidden rows";
+    #pragma omp parallel for schedule(dynamic, 1024)
+    for (int i = 0; i < M; i++) {
+        clause_sizes[i] = clause[i].sz;
+        forbidden[i]    = rows + (size_t)i * width;
+        if (!(i & 0xFFF)) time_up();
+        if (!__atomic_load_n(&timed_out, __ATOMIC_RELAXED))
+            II_process_clause(&clause[i], clause_sizes[i], forbidden[i]);
+    }
+    // The --timeout deadline also covers preparing the clauses; past it the
+    // rows are incomplete and nothing is solved
+    bool prepared = !time_up();
+
+   /* printf("Forbidden matrix (%d clauses):\n", M);
+    for (int i = 0; i < M; i++) {
+        for (int j = 0; j < clause_sizes[i]; j++)
+            printf("%d ", forbidden[i][j]);
         printf("\n");
     }
+    printf("\n");*/
+    SolveMode mode = prepared ? solve_mode(M, forbidden, clause_sizes) : MODE_ENUMERATE;
+    switch (prepared ? mode : MODE_NONE) {
+    case MODE_NONE:       r = RESULT_UNKNOWN; break;
+    case MODE_QBF:        r = solve_qbf(M, forbidden, clause_sizes); break;
+    case MODE_CHECK:      r = check_model(M, forbidden, clause_sizes); break;
+    case MODE_COST:       r = min_cost_assignment(M, forbidden, clause_sizes); break;
+    case MODE_IMPLICATES: r = list_prime_implicates(M, forbidden, clause_sizes); break;
+    case MODE_MINIMIZE:   r = minimize_clauses(M, forbidden, clause_sizes); break;
+    case MODE_PRIME:      r = prime_implicant(M, forbidden, clause_sizes); break;
+    case MODE_PREFER:     r = closest_assignment(M, forbidden, clause_sizes); break;
+    case MODE_SAMPLE:     r = sample_assignments(M, forbidden, clause_sizes); break;
+    case MODE_FORGET:     r = forget_variables(M, forbidden, clause_sizes); break;
+    case MODE_PROJECT:    r = get_projected_assignments(M, forbidden, clause_sizes); break;
+    case MODE_LOCAL:      r = local_search(M, forbidden, clause_sizes); break;
+    case MODE_HORN:       r = horn_first_model(clause_sizes[0]); break;
+    case MODE_ENUMERATE:  r = get_assignments(M, forbidden, clause_sizes); break;
+    }
+    if (r == RESULT_UNKNOWN && timed_out) {
+        report_time_limit();
+    } else if (r == RESULT_UNSAT && !qbf_n) {
+        printf("%sUnsatisfiable, no head or gap or tail of the SAT instance, or the input is invalid%s\n",
+               paint(ANSI_RED), paint(ANSI_RESET));
+        if (opt.proof) write_drat_proof(clause_sizes[0]);
+        if (opt.mus) report_mus(M, forbidden, clause_sizes);
+        if (opt.explain_all) report_all_mus_mcs(M, forbidden, clause_sizes);
+    }
+    if (opt.stats && prepared)
+        print_stats(M, n_input, forbidden, clause_sizes, mode_path(mode), r,
+                    omp_get_wtime() - started);
+    free_constraints();
+    free_qbf_prefix();
+
+    #pragma omp parallel for
+    for (int i = 0; i < M; i++)
+        free(clause[i].orig);
+    free(clause);
+    free(rows);
+    free(forbidden);
+    free(clause_sizes);
+    return r;
+}
+
+static void usage(const char *prog) {
+    fprintf(stderr,
+        "Usage: %s [solve [FILE] | repl] [options]\n"
+        "  solve [FILE]     solve every input in FILE, or stdin if FILE is - or\n"
+        "                   missing, without prompting\n"
+        "  repl             prompt for inputs when stdin is a terminal (the default)\n"
+        "  --limit N        print at most N satisfying assignments\n"
+        "  --project V,...  print assignments to the listed variables only\n"
+        "  --forget V,...   print the clauses left once the variables are forgotten\n"
+        "  --sample K       print K uniformly random satisfying assignments\n"
+        "  --check FILE     verify the model in a solver's v-line output\n"
+        "  --mus            show a minimal unsatisfiable subset when unsatisfiable\n"
+        "  --format F       read input as auto, dimacs, qdimacs or opb\n"
+        "  --explain-all    list every MUS and MCS when unsatisfiable\n"
+        "  --proof FILE     write a DRAT proof when unsatisfiable\n"
+        "  --prefer BITS    print the model closest to a baseline like 0110\n"
+        "  --verify         re-check every printed model against the input\n"
+        "  --prime          print the first model reduced to a prime implicant\n"
+        "  --implicates N   list the prime implicates with at most N literals\n"
+        "  --minimize       print a near-minimal equivalent set of clauses\n"
+        "  --cost L:C,...   print a model of minimum total cost, literal L costing C\n"
+        "  --timeout SEC    give up on a solve after SEC seconds and report unknown\n"
+        "  --stats          print statistics after each solve\n"
+        "  --seed N         seed random choices so runs are reproducible\n"
+        "  --jobs N         use N worker threads (default: one per core)\n"
+        "  --selftest N     cross-check N random formulas against brute force\n"
+        "  --engine E       complete (default) or local: WalkSAT for one model\n"
+        "  --verbose        report duplicate literals and tautologies removed\n"
+        "  --output F       text (default) or json: one JSON object per input\n"
+        "  --quiet          print nothing; exit 10 if the last input is satisfiable,\n"
+        "                   20 if unsatisfiable, 0 if unknown and 1 if invalid\n"
+        "  --no-color       do not color results on a terminal\n"
+        "  --progress       print a progress line on stderr every second\n",
+        prog);
+}
+
+int main(int argc, char **argv) {
+    const char *input_path = NULL;
+    bool solve_cmd = argc > 1 && !strcmp(argv[1], "solve");
+    int  first = solve_cmd || (argc > 1 && !strcmp(argv[1], "repl")) ? 2 : 1;
+    for (int i = first; i < argc; i++) {
+        if (!strcmp(argv[i], "--limit") && i + 1 < argc) {
+            char *end;
+            opt.limit = strtoull(argv[++i], &end, 10);
+            if (*end || argv[i][0] == '-') {
+                fprintf(stderr, "Invalid limit: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--format") && i + 1 < argc) {
+            opt.format = argv[++i];
+            if (strcmp(opt.format, "auto") && strcmp(opt.format, "dimacs") &&
+                strcmp(opt.format, "qdimacs") && strcmp(opt.format, "opb")) {
+                fprintf(stderr, "Unknown format: %s\n", opt.format);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--seed") && i + 1 < argc) {
+            char *end;
+            opt.seed   = strtoull(argv[++i], &end, 10);
+            opt.seeded = true;
+            if (*end || argv[i][0] == '-' || !argv[i][0]) {
+                fprintf(stderr, "Invalid seed: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--jobs") && i + 1 < argc) {
+            char *end;
+            long n = strtol(argv[++i], &end, 10);
+            if (*end || n < 1) {
+                fprintf(stderr, "Invalid job count: %s\n", argv[i]);
+                return 1;
+            }
+            opt.jobs = (int)n;
+        } else if (!strcmp(argv[i], "--selftest") && i + 1 < argc) {
+            char *end;
+            long n = strtol(argv[++i], &end, 10);
+            if (*end || n < 1 || n > 1000000000) {
+                fprintf(stderr, "Invalid selftest count: %s\n", argv[i]);
+                return 1;
+            }
+            opt.selftest = (int)n;
+        } else if (!strcmp(argv[i], "--engine") && i + 1 < argc) {
+            const char *e = argv[++i];
+            if (strcmp(e, "complete") && strcmp(e, "local")) {
+                fprintf(stderr, "Unknown engine: %s\n", e);
+                return 1;
+            }
+            opt.local = !strcmp(e, "local");
+        } else if (!strcmp(argv[i], "--output") && i + 1 < argc) {
+            const char *o = argv[++i];
+            if (strcmp(o, "text") && strcmp(o, "json")) {
+                fprintf(stderr, "Unknown output format: %s\n", o);
+                return 1;
+            }
+            opt.json = !strcmp(o, "json");
+        } else if (!strcmp(argv[i], "--progress")) {
+            opt.progress = true;
+        } else if (!strcmp(argv[i], "--no-color")) {
+            opt.no_color = true;
+        } else if (!strcmp(argv[i], "--quiet")) {
+            opt.quiet = true;
+        } else if (!strcmp(argv[i], "--verbose")) {
+            opt.verbose = true;
+        } else if (!strcmp(argv[i], "--stats")) {
+            opt.stats = true;
+        } else if (!strcmp(argv[i], "--timeout") && i + 1 < argc) {
+            char *end;
+            opt.timeout = strtod(argv[++i], &end);
+            if (*end || !(opt.timeout > 0)) {
+                fprintf(stderr, "Invalid timeout: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--cost") && i + 1 < argc) {
+            char *p = argv[++i], *end;
+            for (;;) {
+                long lit = strtol(p, &end, 10);
+                if (end == p || !lit || *end != ':') {
+                    fprintf(stderr, "Invalid cost list: %s\n", argv[i]);
+                    return 1;
+                }
+                p = end + 1;
+                long long c = strtoll(p, &end, 10);
+                if (end == p || (*end && *end != ',')) {
+                    fprintf(stderr, "Invalid cost list: %s\n", argv[i]);
+                    return 1;
+                }
+                opt.cost_lit = realloc(opt.cost_lit, (opt.n_cost + 1) * sizeof(int));
+                opt.cost     = realloc(opt.cost, (opt.n_cost + 1) * sizeof(long long));
+                opt.cost_lit[opt.n_cost] = (int)lit;
+                opt.cost[opt.n_cost++]   = c;
+                if (!*end) break;
+                p = end + 1;
+            }
+        } else if (!strcmp(argv[i], "--implicates") && i + 1 < argc) {
+            char *end;
+            long n = strtol(argv[++i], &end, 10);
+            if (*end || n < 0 || n > 64) {
+                fprintf(stderr, "Invalid implicate size: %s\n", argv[i]);
+                return 1;
+            }
+            opt.implicates = (int)n;
+        } else if (!strcmp(argv[i], "--minimize")) {
+            opt.minimize = true;
+        } else if (!strcmp(argv[i], "--prime")) {
+            opt.prime = true;
+        } else if (!strcmp(argv[i], "--verify")) {
+            opt.verify = true;
+        } else if (!strcmp(argv[i], "--prefer") && i + 1 < argc) {
+            opt.prefer = argv[++i];
+            if (strspn(opt.prefer, "01") != strlen(opt.prefer) || !*opt.prefer) {
+                fprintf(stderr, "Invalid baseline assignment: %s\n", opt.prefer);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--proof") && i + 1 < argc) {
+            opt.proof = argv[++i];
+        } else if (!strcmp(argv[i], "--explain-all")) {
+            opt.explain_all = true;
+        } else if (!strcmp(argv[i], "--mus")) {
+            opt.mus = true;
+        } else if (!strcmp(argv[i], "--check") && i + 1 < argc) {
+            opt.check = argv[++i];
+        } else if (!strcmp(argv[i], "--sample") && i + 1 < argc) {
+            char *end;
+            opt.sample = strtoull(argv[++i], &end, 10);
+            if (*end || argv[i][0] == '-' || !opt.sample) {
+                fprintf(stderr, "Invalid sample count: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--project") && i + 1 < argc) {
+            if (!parse_var_list(argv[++i], &opt.project, &opt.n_project)) {
+                fprintf(stderr, "Invalid variable list: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (!strcmp(argv[i], "--forget") && i + 1 < argc) {
+            if (!parse_var_list(argv[++i], &opt.forget, &opt.n_forget)) {
+                fprintf(stderr, "Invalid variable list: %s\n", argv[i]);
+                return 1;
+            }
+        } else if (solve_cmd && !input_path && (argv[i][0] != '-' || !strcmp(argv[i], "-"))) {
+            input_path = argv[i];
+        } else {
+            usage(argv[0]);
+            return 1;
+        }
+    }
+
+    // Prompts only make sense for someone typing at a terminal
+    input_file  = stdin;
+    interactive = !solve_cmd && isatty(fileno(stdin));
+    if (input_path && strcmp(input_path, "-")) {
+        if (!(input_file = fopen(input_path, "r"))) {
+            fprintf(stderr, "Cannot open input: %s\n", input_path);
+            return 1;
+        }
+    }
+
+    if (opt.quiet && !freopen(NULL_DEVICE, "w", stdout)) {
+        fprintf(stderr, "Cannot silence output for --quiet\n");
+        return 1;
+    }
+    if (opt.json) atexit(json_at_exit);
+    color = !opt.no_color && !opt.json && !opt.quiet && isatty(fileno(stdout));
+#ifdef _WIN32
+    // Consoles interpret escape sequences only once asked to
+    if (color) {
+        HANDLE out = GetStdHandle(STD_OUTPUT_HANDLE);
+        DWORD  mode;
+        color = GetConsoleMode(out, &mode) &&
+                SetConsoleMode(out, mode | ENABLE_VIRTUAL_TERMINAL_PROCESSING);
+    }
+#endif
+    omp_set_num_threads(opt.jobs ? opt.jobs : omp_get_max_threads());
+    if (opt.selftest)
+        return run_selftest(opt.selftest);
+    Result last = RESULT_UNKNOWN;
+    while (1) {
+        int M;
+        Clause *clause = read_clause(&M);
+        if (end_of_input) {
+            free(clause);
+            break;
+        }
+        // Extra blank lines between inputs in a file are not inputs
+        if (!interactive && !M && !pb_n && !table_n && !formula_n && !qbf_n &&
+            !input_error_line) {
+            free(clause);
+            free_qbf_prefix();
+            continue;
+        }
+        if (opt.json) json_begin();
+        Result r = last = solve_input(clause, M);
+        if (opt.json) {
+            static const char *status[] = { "SAT", "UNSAT", "UNKNOWN", "INVALID" };
+            json_end(status[r]);
+        }
+        else printf("\n");
+    }
+    if (input_file != stdin) fclose(input_file);
+    if (opt.quiet) {
+        // Exit codes of the SAT competition, plus 1 for invalid input
+        static const int code[] = { 10, 20, 0, 1 };
+        return code[last];
+    }
     return 0;
 }